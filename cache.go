@@ -0,0 +1,347 @@
+package chonker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ChunkCache is an on-disk cache of chunks, for content that is downloaded
+// again and again, like toolchains on build machines.
+//
+// Chunks are stored by the URL of their content, query included, or a key set
+// with Request.WithCacheKey, like a hash of the content, along with the ETag,
+// offset, and length of the chunk. Only content with a strong ETag is cached,
+// and chunks are only served from the cache if the ETag of the content, as
+// reported by the probe, still matches. Probing with ProbeHead avoids fetching
+// the first chunk from the server.
+//
+// Once the cache grows larger than its maximum size, the least recently used
+// chunks are removed. Several processes can share a cache directory: chunks
+// are written to temporary files and renamed into place, and reads, writes,
+// and evictions are coordinated with a lock file.
+type ChunkCache struct {
+	dir     string
+	maxSize int64
+
+	// size is an estimate of the size of the cache, which other processes
+	// might change. The cache is walked to find its real size before
+	// evicting chunks.
+	size atomic.Int64
+	// mu serializes evictions in this process.
+	mu sync.Mutex
+}
+
+const (
+	// defaultChunkCacheMaxSize is the maximum size of a ChunkCache configured
+	// with ConfigFromEnv without CHONKER_CACHE_MAX_SIZE.
+	defaultChunkCacheMaxSize = 10 << 30
+
+	cacheLockName   = ".lock"
+	cacheTempPrefix = ".tmp-"
+	// staleCacheTempAge is the age after which temporary files left behind
+	// by processes that crashed are removed.
+	staleCacheTempAge = time.Hour
+)
+
+// NewChunkCache returns a ChunkCache that stores up to maxSize bytes of chunks
+// in dir, which is created if it doesn't exist.
+func NewChunkCache(dir string, maxSize int64) (*ChunkCache, error) {
+	if maxSize <= 0 {
+		return nil, ErrInvalidArgument
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("chonker: error creating cache directory: %w", err)
+	}
+	c := &ChunkCache{dir: dir, maxSize: maxSize}
+	size, err := c.walk(func(string, fs.FileInfo) {})
+	if err != nil {
+		return nil, fmt.Errorf("chonker: error reading cache directory: %w", err)
+	}
+	c.size.Store(size)
+	return c, nil
+}
+
+// path returns the path of chunk of the content with key and etag.
+func (c *ChunkCache) path(key, etag string, chunk Chunk) string {
+	sum := sha256.Sum256([]byte(key + "\n" + etag))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]), fmt.Sprintf("%d-%d", chunk.Start, chunk.Length))
+}
+
+// withLock calls f while holding the lock of the cache directory.
+func (c *ChunkCache) withLock(exclusive bool, f func() error) error {
+	lock, err := os.OpenFile(filepath.Join(c.dir, cacheLockName), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := lockFile(lock, exclusive); err != nil {
+		return err
+	}
+	defer unlockFile(lock) //nolint:errcheck
+	return f()
+}
+
+// get opens the cached chunk of the content with key and etag, if any,
+// and marks it as recently used.
+func (c *ChunkCache) get(key, etag string, chunk Chunk) (*os.File, bool) {
+	var f *os.File
+	err := c.withLock(false, func() error {
+		var err error
+		path := c.path(key, etag, chunk)
+		if f, err = os.Open(path); err != nil {
+			return err
+		}
+		now := time.Now()
+		return os.Chtimes(path, now, now)
+	})
+	if err != nil {
+		if f != nil {
+			f.Close()
+		}
+		return nil, false
+	}
+	return f, true
+}
+
+// create returns a new entry for chunk of the content with key and etag.
+func (c *ChunkCache) create(key, etag string, chunk Chunk) (*cacheEntry, error) {
+	f, err := os.CreateTemp(c.dir, cacheTempPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	return &cacheEntry{File: f, cache: c, path: c.path(key, etag, chunk), chunk: chunk}, nil
+}
+
+// cacheEntry is a chunk being written to the cache.
+type cacheEntry struct {
+	*os.File
+	cache *ChunkCache
+	path  string
+	chunk Chunk
+}
+
+// commit moves the chunk into place, and evicts chunks if the cache has
+// grown too large.
+func (e *cacheEntry) commit() error {
+	if err := e.Close(); err != nil {
+		os.Remove(e.Name())
+		return err
+	}
+	err := e.cache.withLock(true, func() error {
+		if err := os.MkdirAll(filepath.Dir(e.path), 0o755); err != nil {
+			return err
+		}
+		return os.Rename(e.Name(), e.path)
+	})
+	if err != nil {
+		os.Remove(e.Name())
+		return err
+	}
+	if e.cache.size.Add(int64(e.chunk.Length)) > e.cache.maxSize {
+		return e.cache.evict()
+	}
+	return nil
+}
+
+// abort discards the chunk.
+func (e *cacheEntry) abort() {
+	e.Close()
+	os.Remove(e.Name())
+}
+
+// cachedFile is a chunk file found by walking the cache.
+type cachedFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// evict removes the least recently used chunks until the cache fits its
+// maximum size.
+func (c *ChunkCache) evict() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.withLock(true, func() error {
+		var files []cachedFile
+		size, err := c.walk(func(path string, info fs.FileInfo) {
+			files = append(files, cachedFile{path, info.Size(), info.ModTime()})
+		})
+		if err != nil {
+			return err
+		}
+		sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+		for _, f := range files {
+			if size <= c.maxSize {
+				break
+			}
+			if err := os.Remove(f.path); err == nil || errors.Is(err, fs.ErrNotExist) {
+				size -= f.size
+				// Remove the directory of the content once it is empty.
+				os.Remove(filepath.Dir(f.path))
+			}
+		}
+		c.size.Store(size)
+		return nil
+	})
+}
+
+// walk calls f for every chunk in the cache, and returns their total size.
+// It removes stale temporary files along the way.
+func (c *ChunkCache) walk(f func(string, fs.FileInfo)) (int64, error) {
+	var size int64
+	err := filepath.Walk(c.dir, func(path string, info fs.FileInfo, err error) error {
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			// Removed by another process.
+			return nil
+		case err != nil:
+			return err
+		case info.IsDir() || info.Name() == cacheLockName:
+			return nil
+		case strings.HasPrefix(info.Name(), cacheTempPrefix):
+			if time.Since(info.ModTime()) > staleCacheTempAge {
+				os.Remove(path)
+			}
+			return nil
+		}
+		size += info.Size()
+		f(path, info)
+		return nil
+	})
+	return size, err
+}
+
+// WithChunkCache configures r to serve chunks from cache, and to store the
+// chunks it fetches there. See ChunkCache for details.
+func (r *Request) WithChunkCache(cache *ChunkCache) *Request {
+	r.cache = cache
+	return r
+}
+
+// WithCacheKey sets the key that the chunks of r are cached by, like a hash of
+// the content, instead of its URL. Use it for content served at several URLs,
+// or at URLs that change, like presigned URLs, whose signatures are part of
+// the query.
+func (r *Request) WithCacheKey(key string) *Request {
+	r.cacheKey = key
+	return r
+}
+
+// chunkCacheKey returns the key that the chunks of r are cached by.
+// URLs are kept whole, queries included, since queries can pick the content.
+func (r *Request) chunkCacheKey() string {
+	if r.cacheKey != "" {
+		return r.cacheKey
+	}
+	return r.URL.String()
+}
+
+// caching reports whether chunks of the content are cached.
+func (r *remoteFileReader) caching() bool {
+	return r.request.cache != nil && r.validator != "" && !r.sizeUnknown
+}
+
+// fetchCached serves chunk from the cache, if it is there.
+// Otherwise, it fetches chunk with req, and caches it as it is read.
+func (r *remoteFileReader) fetchCached(req *http.Request, chunk Chunk) (*http.Response, error) {
+	if resp, ok := r.cachedResponse(req, chunk); ok {
+		return resp, nil
+	}
+	resp, err := r.fetch(req, chunk)
+	return r.cacheResponse(resp, chunk), err
+}
+
+// cachedResponse returns a response to req that serves chunk from the cache,
+// if it is there.
+func (r *remoteFileReader) cachedResponse(req *http.Request, chunk Chunk) (*http.Response, bool) {
+	if !r.caching() {
+		return nil, false
+	}
+	f, ok := r.request.cache.get(r.request.chunkCacheKey(), r.validator, chunk)
+	if !ok {
+		return nil, false
+	}
+	getHostMetrics(r.request.URL.Host).requestChunksCachedTotal.Inc()
+	header := make(http.Header)
+	header.Set(headerNameContentRange, chunk.ContentRangeHeader(r.size))
+	header.Set(headerNameContentLength, strconv.FormatUint(chunk.Length, 10))
+	header.Set(headerNameETag, r.validator)
+	return &http.Response{
+		Status:        http.StatusText(http.StatusPartialContent),
+		StatusCode:    http.StatusPartialContent,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		ContentLength: int64(chunk.Length),
+		Body:          f,
+		Request:       req,
+	}, true
+}
+
+// cacheResponse makes reading resp, a response for chunk, store the chunk in
+// the cache, if it is the chunk of the content that was probed.
+func (r *remoteFileReader) cacheResponse(resp *http.Response, chunk Chunk) *http.Response {
+	if !r.caching() || resp == nil || resp.StatusCode != http.StatusPartialContent {
+		return resp
+	}
+	if etag := resp.Header.Get(headerNameETag); etag != r.validator {
+		return resp
+	}
+	if got, _, err := ParseContentRange(resp.Header.Get(headerNameContentRange)); err != nil || *got != chunk {
+		return resp
+	}
+	entry, err := r.request.cache.create(r.request.chunkCacheKey(), r.validator, chunk)
+	if err != nil {
+		r.request.logger().Warn("chonker: error caching chunk", "url", r.request.URL.String(), "error", err)
+		return resp
+	}
+	resp.Body = &cacheFillBody{ReadCloser: resp.Body, entry: entry, logger: r.request.logger}
+	return resp
+}
+
+// cacheFillBody writes the bytes read from a chunk response body to a cache
+// entry, which is committed when the body is closed after the whole chunk,
+// and nothing more, was read.
+type cacheFillBody struct {
+	io.ReadCloser
+	entry  *cacheEntry
+	logger func() *slog.Logger
+	n      int64
+	err    error
+}
+
+func (b *cacheFillBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && b.err == nil {
+		_, b.err = b.entry.Write(p[:n])
+	}
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *cacheFillBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.err != nil || b.n != int64(b.entry.chunk.Length) {
+		b.entry.abort()
+		return err
+	}
+	if commitErr := b.entry.commit(); commitErr != nil {
+		b.logger().Warn("chonker: error caching chunk", "error", commitErr)
+	}
+	return err
+}
@@ -0,0 +1,177 @@
+package chonker
+
+import (
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rangeRequests returns the number of GET requests for ranges that s got,
+// and forgets them.
+func rangeRequests(s *contentServer) int {
+	var n int
+	for _, r := range s.requested() {
+		if r.Method == http.MethodGet && r.Header.Get("Range") != "" {
+			n++
+		}
+	}
+	s.reset()
+	return n
+}
+
+// cachedFiles returns the sizes of the chunks in the cache directory dir.
+func cachedFiles(t *testing.T, dir string) []int64 {
+	var sizes []int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || d.Name() == cacheLockName {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		assert.False(t, strings.HasPrefix(d.Name(), cacheTempPrefix), path)
+		sizes = append(sizes, info.Size())
+		return nil
+	})
+	assert.NoError(t, err)
+	return sizes
+}
+
+func TestDo_ChunkCache(t *testing.T) {
+	handler := &contentServer{content: makeData(1000), etag: `"v1"`}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	cache, err := NewChunkCache(t.TempDir(), 1<<20)
+	assert.NoError(t, err)
+
+	download := func(key string) []byte {
+		req, err := NewRequest(http.MethodGet, server.URL+"/file?sig=abc", nil, 100, 4)
+		assert.NoError(t, err)
+		req = req.WithChunkCache(cache).WithCacheKey(key).WithProbeStrategy(ProbeHead)
+		resp, err := Do(nil, req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		got, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return got
+	}
+
+	// The first download fills the cache.
+	assert.Equal(t, handler.content, download(""))
+	assert.Equal(t, 10, rangeRequests(handler))
+	assert.Len(t, cachedFiles(t, cache.dir), 10)
+
+	// The second download is served from the cache.
+	assert.Equal(t, handler.content, download(""))
+	assert.Zero(t, rangeRequests(handler))
+
+	// Other cache keys don't share chunks.
+	assert.Equal(t, handler.content, download("sha256:abc"))
+	assert.Equal(t, 10, rangeRequests(handler))
+
+	// Changed content isn't served from the cache.
+	handler.change(makeData(1000)[1:], `"v2"`)
+	assert.Equal(t, handler.content, download(""))
+	assert.Equal(t, 10, rangeRequests(handler))
+}
+
+func TestDo_ChunkCacheQuery(t *testing.T) {
+	handler := &contentServer{content: makeData(1000), etag: `"v1"`}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	cache, err := NewChunkCache(t.TempDir(), 1<<20)
+	assert.NoError(t, err)
+
+	download := func(url string) {
+		req, err := NewRequest(http.MethodGet, url, nil, 100, 4)
+		assert.NoError(t, err)
+		resp, err := Do(nil, req.WithChunkCache(cache).WithProbeStrategy(ProbeHead))
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		got, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, handler.content, got)
+	}
+
+	download(server.URL + "/download?id=1")
+	assert.Equal(t, 10, rangeRequests(handler))
+
+	// URLs that differ only in their query can name different content,
+	// even with the same ETag, so they don't share chunks.
+	download(server.URL + "/download?id=2")
+	assert.Equal(t, 10, rangeRequests(handler))
+
+	download(server.URL + "/download?id=1")
+	assert.Zero(t, rangeRequests(handler))
+}
+
+func TestChunkCache_Evict(t *testing.T) {
+	handler := &contentServer{content: makeData(1000), etag: `"v1"`}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	cache, err := NewChunkCache(t.TempDir(), 450)
+	assert.NoError(t, err)
+
+	// Read the content in order, so that the first chunks are the least
+	// recently used.
+	req, err := NewRequest(http.MethodGet, server.URL, nil, 100, 1)
+	assert.NoError(t, err)
+	resp, err := Do(nil, req.WithChunkCache(cache).WithProbeStrategy(ProbeHead))
+	assert.NoError(t, err)
+	got, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, handler.content, got)
+
+	sizes := cachedFiles(t, cache.dir)
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	assert.LessOrEqual(t, total, int64(450))
+	assert.NotEmpty(t, sizes)
+
+	// The last chunks are still cached.
+	_, ok := cache.get(server.URL, `"v1"`, Chunk{Start: 900, Length: 100})
+	assert.True(t, ok)
+	_, ok = cache.get(server.URL, `"v1"`, Chunk{Start: 0, Length: 100})
+	assert.False(t, ok)
+}
+
+func TestChunkCache_Invalid(t *testing.T) {
+	_, err := NewChunkCache(t.TempDir(), 0)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+}
+
+func TestNewClientWithOptions_ChunkCache(t *testing.T) {
+	handler := &contentServer{content: makeData(1000), etag: `"v1"`}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	cache, err := NewChunkCache(t.TempDir(), 1<<20)
+	assert.NoError(t, err)
+	client, err := NewClientWithOptions(nil, WithChunkSize(100), WithWorkers(4), WithChunkCache(cache))
+	assert.NoError(t, err)
+
+	// The second request skips the probe, which is cached by the round
+	// tripper, and is served from the chunk cache entirely.
+	for _, want := range []int{10, 0} {
+		resp, err := client.Get(server.URL)
+		assert.NoError(t, err)
+		got, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.NoError(t, err)
+		assert.Equal(t, handler.content, got)
+		assert.Equal(t, want, rangeRequests(handler))
+	}
+}
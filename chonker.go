@@ -14,7 +14,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/sourcegraph/conc/stream"
 )
@@ -37,6 +41,39 @@ type Request struct {
 	workers   uint
 
 	continueWithoutRange bool
+	recoverRange         bool
+	decodeContent        bool
+
+	probeStrategy ProbeStrategy
+	sizeKnown     bool
+	size          uint64
+	validator     string
+
+	probeCache ProbeCache
+	planner    ChunkPlanner
+
+	readAhead  uint64
+	hedgeAfter time.Duration
+	hedging    *Hedging
+
+	chunkTimeouts *ChunkTimeouts
+	retry         Retry
+	log           *slog.Logger
+
+	minSize      uint64
+	contentTypes []string
+
+	redirects RedirectResolution
+	refresher URLRefresher
+
+	connections Connections
+
+	cache    *ChunkCache
+	cacheKey string
+
+	// untimedWhole is true if whole content isn't limited by the Timeout of
+	// the client, which is then meant for chunks.
+	untimedWhole bool
 }
 
 func (r Request) isValid() bool {
@@ -50,29 +87,120 @@ func (r *Request) WithOpportunisticRange() *Request {
 	return r
 }
 
+// WithRangeRecovery configures r to recover from chunk requests that the
+// server answers with the whole content instead of the requested range.
+// This happens when only some of the servers behind a load balancer support
+// range requests. The bytes before the chunk are discarded, and the chunk is
+// read from the rest of the response.
+func (r *Request) WithRangeRecovery() *Request {
+	r.recoverRange = true
+	return r
+}
+
+// WithProbeStrategy configures how r probes the server for range support.
+// See ProbeStrategy for the available strategies.
+func (r *Request) WithProbeStrategy(s ProbeStrategy) *Request {
+	r.probeStrategy = s
+	return r
+}
+
+// WithKnownSize configures r to skip probing the server.
+// size is the size of the content and validator is its ETag.
+// If validator is not empty, chunks are fetched only if the content still matches it.
+func (r *Request) WithKnownSize(size uint64, validator string) *Request {
+	r.sizeKnown = true
+	r.size = size
+	r.validator = validator
+	return r
+}
+
+// WithChunkPlanner configures how r divides content into chunks.
+// It overrides the chunk size r was created with.
+func (r *Request) WithChunkPlanner(p ChunkPlanner) *Request {
+	r.planner = p
+	return r
+}
+
+// WithReadAhead configures r to fetch chunks only up to window bytes ahead of
+// the position the response body has been read to, for consumers that read
+// slowly, like video players. Memory use and load on the server then stay
+// bounded however long the body is read for.
+// The chunk the reader is waiting for is always fetched. If hedgeAfter is
+// not zero and that chunk takes longer than hedgeAfter to respond,
+// it is requested again, and the first response is used.
+func (r *Request) WithReadAhead(window uint64, hedgeAfter time.Duration) *Request {
+	r.readAhead = window
+	r.hedgeAfter = hedgeAfter
+	return r
+}
+
+// WithHedging configures r to hedge chunk requests that are slow.
+// See Hedging for details. Hedging replaces the hedging of WithReadAhead.
+func (r *Request) WithHedging(h Hedging) *Request {
+	r.hedging = &h
+	return r
+}
+
+// WithChunkTimeouts configures r to detect chunks that stall, and fetch
+// them again. See ChunkTimeouts for details.
+func (r *Request) WithChunkTimeouts(t ChunkTimeouts) *Request {
+	r.chunkTimeouts = &t
+	return r
+}
+
+// WithRetry configures r to retry failed chunks up to attempts times in total,
+// waiting backoff before the first retry and twice as long before each next one.
+// See Retry for the failures that are retried.
+func (r *Request) WithRetry(attempts int, backoff time.Duration) *Request {
+	r.retry = Retry{Attempts: attempts, Backoff: backoff}
+	return r
+}
+
+// WithLogger configures r to log retries, hedges, and failures of chunks to l.
+func (r *Request) WithLogger(l *slog.Logger) *Request {
+	r.log = l
+	return r
+}
+
+// logger returns the logger of r, which discards logs unless WithLogger was used.
+func (r *Request) logger() *slog.Logger {
+	if r.log != nil {
+		return r.log
+	}
+	return discardLogger
+}
+
+// chunkPlanner returns the planner of r, which plans chunks of the chunk size
+// of r unless WithChunkPlanner was used.
+func (r *Request) chunkPlanner() ChunkPlanner {
+	if r.planner != nil {
+		return r.planner
+	}
+	return FixedChunkPlanner(r.chunkSize)
+}
+
+// subRequest returns a copy of the request in r with ctx, for a probe or chunk request.
+func (r *Request) subRequest(ctx context.Context, method string) *http.Request {
+	req := r.Clone(ctx)
+	if method != "" {
+		req.Method = method
+	}
+	r.setAcceptEncoding(req.Header)
+	return req
+}
+
 // NewRequestWithContext returns a new Request.
 // It is a wrapper around http.NewRequestWithContext that adds support for ranged requests.
 // A ranged request is a request that is fetched in chunks using several HTTP requests.
 // Chunks are chunkSize bytes long. A maximum of workers chunks are fetched concurrently.
+// See NewRequestWithOptions for more settings.
 func NewRequestWithContext(
 	ctx context.Context,
 	method, url string,
 	body io.Reader,
 	chunkSize uint64, workers uint,
 ) (*Request, error) {
-	req, err := http.NewRequestWithContext(ctx, method, url, body)
-	if err != nil {
-		return nil, err
-	}
-	r := &Request{
-		Request:   req,
-		chunkSize: chunkSize,
-		workers:   workers,
-	}
-	if !r.isValid() {
-		return nil, ErrInvalidArgument
-	}
-	return r, nil
+	return NewRequestWithOptions(ctx, method, url, body, WithChunkSize(chunkSize), WithWorkers(workers))
 }
 
 // NewRequest returns a new Request.
@@ -91,6 +219,8 @@ func NewRequest(
 // It is a wrapper around http.Client.Do that adds support for ranged requests.
 // A ranged request is a request that is fetched in chunks using several HTTP requests.
 // Chunks are chunkSize bytes long. A maximum of workers chunks are fetched concurrently.
+// The first chunk doubles as a probe for range support, so a response that fits
+// in a single chunk is fetched with a single request.
 // HTTP HEAD requests are not fetched in chunks.
 func Do(c *http.Client, r *Request) (*http.Response, error) {
 	if r == nil || r.Request == nil {
@@ -106,126 +236,309 @@ func Do(c *http.Client, r *Request) (*http.Response, error) {
 		return c.Do(r.Request)
 	}
 
-	ctx := r.Context()
+	reqRangeVal := r.Header.Get(headerNameRange)
+
+	if r.sizeKnown {
+		// Skip probing and plan chunks from what the caller told us.
+		header := make(http.Header)
+		if r.validator != "" {
+			header.Set(headerNameETag, r.validator)
+		}
+		return respond(c, r, syntheticProbeResponse(header), nil, r.size)
+	}
+
+	if r.probeCache != nil {
+		if p, ok := r.probeCache.Get(probeCacheKey(r.URL)); ok && p.RangeSupported && p.matches(r.Request) {
+			return respond(c, r, syntheticProbeResponse(p.Header.Clone()), nil, p.Size)
+		}
+		if r.continueWithoutRange && r.rangeUnsupported() {
+			// The URL or its host is known not to support range requests. Skip the probe.
+			resp, err := r.wholeClient(c).Do(r.Request)
+			if err != nil {
+				return nil, err
+			}
+			hostMetrics := getHostMetrics(r.URL.Host)
+			hostMetrics.requestsTotal.Inc()
+			hostMetrics.requestsTotalSansRange.Inc()
+			return resp, nil
+		}
+	}
+
+	if r.probeStrategy == ProbeHead {
+		probeResp, size, ok, err := probeHead(c, r)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			r.cacheProbeResult(probeResp, size)
+			return respond(c, r, probeResp, nil, size)
+		}
+		// Fall back to probing with a ranged GET request.
+	}
 
 	// Probe the server to see if it supports range requests.
-	// If it does, fetch the requested range.
 	// We'd normally do a HEAD request here, but some servers don't support HEAD requests.
-	// So we do a GET request for the first byte of the file.
-	probeReq := r.Clone(ctx)
-	probeReq.Method = http.MethodGet
-	probeReq.Header.Set(headerNameRange, Chunk{0, 1}.RangeHeader())
-	probeResp, err := c.Do(probeReq)
+	// So we do a GET request for the first chunk of the requested range instead.
+	// If the server supports range requests, the probe response body becomes
+	// the head of the returned response body.
+	probeRange, err := probeChunk(reqRangeVal, r.chunkPlanner())
 	if err != nil {
 		return nil, err
 	}
-
-	hostMetrics := getHostMetrics(r.URL.Host)
-
+	// The probe might be answered with the whole content, so if the Timeout of
+	// c doesn't apply to whole content, it only applies to the probe until it
+	// turns out to be a chunk.
+	whole := r.wholeClient(c)
+	probeCtx, cancelProbe := context.WithCancel(r.Context())
+	stopProbeTimer := func() bool { return false }
+	if whole != c {
+		stopProbeTimer = time.AfterFunc(c.Timeout, cancelProbe).Stop
+	}
+	probeReq := r.subRequest(probeCtx, http.MethodGet)
+	probeReq.Header.Set(headerNameRange, probeRange.RangeHeader())
+	probeResp, err := whole.Do(probeReq)
+	if err != nil {
+		stopProbeTimer()
+		cancelProbe()
+		return nil, &ProbeError{URL: r.URL.String(), Err: err}
+	}
+	probeResp.Body = &cancelOnCloseBody{ReadCloser: probeResp.Body, cancel: func() {
+		stopProbeTimer()
+		cancelProbe()
+	}}
 	if probeResp.StatusCode == http.StatusOK {
+		r.cacheRangeUnsupported(probeResp.Header)
 		if !r.continueWithoutRange {
-			return nil, ErrRangeUnsupported
+			probeResp.Body.Close()
+			return nil, newProbeError(r, probeResp, ErrRangeUnsupported)
 		}
 
 		// The server does not support range requests but we're configured to continue anyway.
-		// Return the response as-is.
+		// Return the response as-is, decoded unless an encoding was asked for.
+		stopProbeTimer()
+		if err := r.decodeWholeBody(probeResp); err != nil {
+			probeResp.Body.Close()
+			return nil, err
+		}
+		hostMetrics := getHostMetrics(r.URL.Host)
 		hostMetrics.requestsTotal.Inc()
+		hostMetrics.requestsTotalSansRange.Inc()
 		return probeResp, nil
 	}
 
 	if probeResp.StatusCode != http.StatusPartialContent {
-		return nil, fmt.Errorf("unexpected status code %d", probeResp.StatusCode)
+		probeResp.Body.Close()
+		return nil, newProbeError(r, probeResp, nil)
+	}
+	if err := r.checkEncoding(probeResp.Header); err != nil {
+		probeResp.Body.Close()
+		return nil, newProbeError(r, probeResp, err)
 	}
 
 	crHeader := probeResp.Header.Get(headerNameContentRange)
-	_, contentLength, err := ParseContentRange(crHeader)
+	gotRange, contentLength, err := ParseContentRange(crHeader)
 	if err != nil {
-		return nil, fmt.Errorf("chonker: error parsing Content-Range header %s: %w", crHeader, err)
+		probeResp.Body.Close()
+		return nil, newProbeError(r, probeResp,
+			fmt.Errorf("chonker: error parsing Content-Range header %s: %w", crHeader, err))
 	}
 
+	if contentLength != UnknownSize {
+		r.cacheProbeResult(probeResp, contentLength)
+	}
+	return respond(c, r, probeResp, gotRange, contentLength)
+}
+
+// cacheProbeResult stores the result of a successful probe in the probe cache of r, if any.
+func (r *Request) cacheProbeResult(probeResp *http.Response, size uint64) {
+	if r.probeCache == nil {
+		return
+	}
+	if p, ok := newProbeResult(r.Request, probeResp, size); ok {
+		r.probeCache.Set(probeCacheKey(r.URL), p)
+	}
+}
+
+// wholeClient returns the client to send requests that might fetch whole
+// content with. For requests sent through a client from NewClientWithOptions,
+// whose Timeout is meant for chunks, it is c without its Timeout, since whole
+// content takes longer than a chunk. Otherwise, it is c.
+func (r *Request) wholeClient(c *http.Client) *http.Client {
+	if !r.untimedWhole || c.Timeout == 0 {
+		return c
+	}
+	whole := *c
+	whole.Timeout = 0
+	return &whole
+}
+
+// syntheticProbeResponse returns a stand-in probe response with header,
+// for requests that are planned without probing the server.
+func syntheticProbeResponse(header http.Header) *http.Response {
+	return &http.Response{
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Body:       http.NoBody,
+	}
+}
+
+// respond returns the response to r, whose body fetches the requested range in chunks.
+// contentLength is the total size of the content, which might be UnknownSize.
+// The status line and headers of the response are based on probeResp.
+// If head is not nil, the body of probeResp holds the bytes in head,
+// and becomes the first chunk of the response body if it fits the plan.
+// Otherwise, the body of probeResp is closed unread.
+func respond(
+	c *http.Client,
+	r *Request,
+	probeResp *http.Response,
+	head *Chunk,
+	contentLength uint64,
+) (*http.Response, error) {
 	reqRangeVal := r.Header.Get(headerNameRange)
-	var chunks []Chunk
+	sizeKnown := contentLength != UnknownSize
+	var requestedRange Chunk
+	var statusCode int
+	header := probeResp.Header.Clone()
 
 	if reqRangeVal == "" {
-		chunks = Chunks(r.chunkSize, 0, contentLength)
+		requestedRange = Chunk{0, contentLength}
+		if !sizeKnown {
+			requestedRange.Length = math.MaxInt64
+		}
 
 		// Remove partial response status code and Content-Range header from the response.
-		probeResp.Header.Del(headerNameContentRange)
-		probeResp.StatusCode = http.StatusOK
-		probeResp.Status = http.StatusText(http.StatusOK)
+		header.Del(headerNameContentRange)
+		statusCode = http.StatusOK
 	} else {
 		// The original request had a Range header.
 		// Fetch the requested range.
 		// Add the Content-Range header to the generated response.
-		cs, err := ParseRange(reqRangeVal, contentLength)
+		size := contentLength
+		if !sizeKnown {
+			if isSuffixRange(reqRangeVal) {
+				probeResp.Body.Close()
+				return nil, fmt.Errorf("chonker: can't fetch suffix range %s of content of unknown size", reqRangeVal)
+			}
+			size = math.MaxInt64
+		}
+		cs, err := ParseRange(reqRangeVal, size)
 		if err != nil {
+			probeResp.Body.Close()
 			return nil, fmt.Errorf(
 				"chonker: error parsing requested range %s: %w",
 				reqRangeVal,
 				err,
 			)
 		} else if len(cs) > 1 {
+			probeResp.Body.Close()
 			return nil, ErrMultipleRangesUnsupported
 		}
-		requestedRange := cs[0]
+		requestedRange = cs[0]
 
 		// Add partial response status and Content-Range header to the response.
-		probeResp.Header.Set(headerNameContentRange, requestedRange.ContentRangeHeader(contentLength))
-		probeResp.StatusCode = http.StatusPartialContent
-		probeResp.Status = http.StatusText(http.StatusPartialContent)
-
-		// Set content length to the length of the requested range.
-		contentLength = requestedRange.Length
-		chunks = Chunks(r.chunkSize, requestedRange.Start, requestedRange.Start+requestedRange.Length)
-	}
-
-	read, write := io.Pipe()
-	remoteFile := &remoteFileReader{
-		PipeReader: read,
-		client:     c,
-		request:    r,
+		statusCode = http.StatusPartialContent
+		switch {
+		case sizeKnown:
+			header.Set(headerNameContentRange, requestedRange.ContentRangeHeader(contentLength))
+		case requestedRange.Start+requestedRange.Length < math.MaxInt64:
+			header.Set(headerNameContentRange, fmt.Sprintf("bytes %d-%d/*",
+				requestedRange.Start, requestedRange.Start+requestedRange.Length-1))
+		default:
+			header.Del(headerNameContentRange)
+		}
 	}
-	fetchers := stream.New().WithMaxGoroutines(int(r.workers))
-	go remoteFile.fetchChunks(ctx, chunks, fetchers, write)
 
 	rangeResponse := http.Response{
-		Status:     probeResp.Status,
-		StatusCode: probeResp.StatusCode,
+		Status:     http.StatusText(statusCode),
+		StatusCode: statusCode,
 		Proto:      probeResp.Proto,
 		ProtoMajor: probeResp.ProtoMajor,
 		ProtoMinor: probeResp.ProtoMinor,
 		TLS:        probeResp.TLS,
 
 		// Synthesised fields.
-		ContentLength: int64(contentLength),
-		Header:        probeResp.Header,
-		Body:          remoteFile,
+		ContentLength: -1,
+		Header:        header,
 		Request:       r.Request,
 	}
+	if !r.shouldChunk(header, contentLength) && (head == nil || *head != requestedRange) {
+		// The content is not worth fetching in chunks, and the probe
+		// response doesn't hold all of it. Fetch it with a plain request.
+		probeResp.Body.Close()
+		return r.doUnchunked(c)
+	}
 
-	hostMetrics.requestsTotal.Inc()
+	if sizeKnown {
+		// Set content length to the length of the requested range.
+		rangeResponse.ContentLength = int64(requestedRange.Length)
+		header.Set(headerNameContentLength, strconv.FormatUint(requestedRange.Length, 10))
+	} else {
+		header.Del(headerNameContentLength)
+	}
+
+	chunks := &chunkPlan{
+		planner: r.chunkPlanner(),
+		next:    requestedRange.Start,
+		end:     requestedRange.Start + requestedRange.Length,
+	}
+	first, _ := chunks.peek()
+	resolvedBy := probeResp
+
+	// The probe response body is the first chunk if the server returned the range we planned.
+	// It might not be, for instance when a suffix range was requested.
+	// In that case, discard it and fetch every chunk.
+	// If the size of the content is unknown, the probe response body might
+	// be shorter than the first chunk, and then it holds all of the content.
+	switch {
+	case head != nil && *head == first:
+		if first.Length == requestedRange.Length {
+			// The whole range fits in the first chunk. Skip the chunk machinery entirely.
+			rangeResponse.Body = probeResp.Body
+		}
+	case head != nil && !sizeKnown && head.Start == first.Start && head.Length < first.Length:
+		rangeResponse.Body = probeResp.Body
+	default:
+		probeResp.Body.Close()
+		probeResp = nil
+	}
+
+	if rangeResponse.Body == nil {
+		remoteFile, write := newRemoteFileReader(c, r, strongValidator(header))
+		remoteFile.sizeUnknown = !sizeKnown
+		remoteFile.size = contentLength
+		remoteFile.readPos.Store(requestedRange.Start)
+		remoteFile.resolve(resolvedBy)
+		remoteFile.conns = r.connPool(c, resolvedBy)
+		fetchers := stream.New().WithMaxGoroutines(int(r.workers))
+		go remoteFile.fetchChunks(r.Context(), probeResp, chunks, fetchers, write)
+		rangeResponse.Body = remoteFile
+	}
+	if r.decodeContent {
+		if err := decodeBody(&rangeResponse); err != nil {
+			rangeResponse.Body.Close()
+			return nil, err
+		}
+	}
+
+	getHostMetrics(r.URL.Host).requestsTotal.Inc()
 	return &rangeResponse, nil
 }
 
 // New returns a chonker client with default settings.
 // The client fetches four 1MiB chunks concurrently.
 func New() *http.Client {
-	return &http.Client{
-		Transport: newRoundTripper(nil, 1024*1024, 4),
-	}
+	c, _ := NewClientWithOptions(nil)
+	return c
 }
 
 // NewClient returns a new http.Client that fetches requests in chunks.
 // The returned client's Transport is a http.RoundTripper from NewRoundTripper.
+// See NewClientWithOptions for how the policies of c are kept, and for more settings.
 func NewClient(c *http.Client, chunkSize uint64, workers uint) (*http.Client, error) {
-	transport, err := NewRoundTripper(c, chunkSize, workers)
-	if err != nil {
-		return nil, err
-	}
-
-	return &http.Client{
-		Transport: transport,
-	}, nil
+	return NewClientWithOptions(c, WithChunkSize(chunkSize), WithWorkers(workers))
 }
 
 type roundTripper func(*http.Request) (*http.Response, error)
@@ -235,21 +548,9 @@ func (r roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 }
 
 // NewRoundTripper returns a new http.RoundTripper that fetches requests in chunks.
+// Probe results are cached for up to DefaultProbeCacheTTL and shared by every
+// request sent through the returned http.RoundTripper.
+// See NewRoundTripperWithOptions for more settings.
 func NewRoundTripper(c *http.Client, chunkSize uint64, workers uint) (http.RoundTripper, error) {
-	if chunkSize < 1 || workers < 1 {
-		return nil, ErrInvalidArgument
-	}
-
-	return newRoundTripper(c, chunkSize, workers), nil
-}
-
-func newRoundTripper(c *http.Client, chunkSize uint64, workers uint) http.RoundTripper {
-	return roundTripper(func(r *http.Request) (*http.Response, error) {
-		req := Request{
-			Request:   r,
-			chunkSize: chunkSize,
-			workers:   workers,
-		}
-		return Do(c, &req)
-	})
+	return NewRoundTripperWithOptions(c, WithChunkSize(chunkSize), WithWorkers(workers))
 }
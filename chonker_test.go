@@ -2,11 +2,17 @@ package chonker
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"fmt"
+	"io"
+	"math"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"testing/iotest"
 	"time"
@@ -330,7 +336,7 @@ func TestDo_ChunkRequestNotSupported(t *testing.T) {
 	server := httptest.NewServer(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			// Probe request will succeed but chunk requests will fail.
-			if rng := r.Header.Get("Range"); rng != "" && rng != "bytes=0-0" {
+			if rng := r.Header.Get("Range"); rng != "" && rng != "bytes=0-63" {
 				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
@@ -349,6 +355,791 @@ func TestDo_ChunkRequestNotSupported(t *testing.T) {
 	assert.Error(t, iotest.TestReader(resp.Body, content))
 }
 
+func TestDo_ProbeIsFirstChunk(t *testing.T) {
+	content := makeData(1024)
+
+	testCases := []struct {
+		name        string
+		chunkSize   uint64
+		rangeHeader string
+		body        []byte
+		ranges      []string
+	}{
+		{
+			name:      "single chunk",
+			chunkSize: 4096,
+			body:      content,
+			ranges:    []string{"bytes=0-4095"},
+		},
+		{
+			name:      "several chunks",
+			chunkSize: 512,
+			body:      content,
+			ranges:    []string{"bytes=0-511", "bytes=512-1023"},
+		},
+		{
+			name:        "range within a chunk",
+			chunkSize:   512,
+			rangeHeader: "bytes=100-199",
+			body:        content[100:200],
+			ranges:      []string{"bytes=100-199"},
+		},
+		{
+			name:        "range across chunks",
+			chunkSize:   512,
+			rangeHeader: "bytes=500-",
+			body:        content[500:],
+			ranges:      []string{"bytes=500-511", "bytes=512-1023"},
+		},
+		{
+			name:        "suffix range",
+			chunkSize:   512,
+			rangeHeader: "bytes=-100",
+			body:        content[924:],
+			ranges:      []string{"bytes=0-0", "bytes=924-1023"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var ranges []string
+			server := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					mu.Lock()
+					ranges = append(ranges, r.Header.Get("Range"))
+					mu.Unlock()
+					http.ServeContent(w, r, "", time.Now(), bytes.NewReader(content))
+				}),
+			)
+			defer server.Close()
+
+			req, err := NewRequest(http.MethodGet, server.URL, nil, testCase.chunkSize, 1)
+			assert.NoError(t, err)
+			if testCase.rangeHeader != "" {
+				req.Header.Set("Range", testCase.rangeHeader)
+			}
+
+			resp, err := Do(nil, req)
+			assert.NoError(t, err)
+			defer resp.Body.Close()
+
+			assert.Equal(t, int64(len(testCase.body)), resp.ContentLength)
+			assert.NoError(t, iotest.TestReader(resp.Body, testCase.body))
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Equal(t, testCase.ranges, ranges)
+		})
+	}
+}
+
+func TestDo_ProbeStrategy(t *testing.T) {
+	content := makeData(1024)
+
+	testCases := []struct {
+		name        string
+		rejectHead  bool
+		setup       func(*Request) *Request
+		rangeHeader string
+		body        []byte
+		requests    []string
+		err         bool
+	}{
+		{
+			name:     "head",
+			setup:    func(r *Request) *Request { return r.WithProbeStrategy(ProbeHead) },
+			body:     content,
+			requests: []string{"HEAD ", "GET bytes=0-511", "GET bytes=512-1023"},
+		},
+		{
+			name:        "head with range",
+			setup:       func(r *Request) *Request { return r.WithProbeStrategy(ProbeHead) },
+			rangeHeader: "bytes=-100",
+			body:        content[924:],
+			requests:    []string{"HEAD ", "GET bytes=924-1023"},
+		},
+		{
+			name:       "head rejected",
+			rejectHead: true,
+			setup:      func(r *Request) *Request { return r.WithProbeStrategy(ProbeHead) },
+			body:       content,
+			requests:   []string{"HEAD ", "GET bytes=0-511", "GET bytes=512-1023"},
+		},
+		{
+			name:     "known size",
+			setup:    func(r *Request) *Request { return r.WithKnownSize(1024, `"v1"`) },
+			body:     content,
+			requests: []string{"GET bytes=0-511", "GET bytes=512-1023"},
+		},
+		{
+			name:  "known size with stale validator",
+			setup: func(r *Request) *Request { return r.WithKnownSize(1024, `"v0"`) },
+			err:   true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var requests []string
+			server := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					mu.Lock()
+					requests = append(requests, r.Method+" "+r.Header.Get("Range"))
+					mu.Unlock()
+					if testCase.rejectHead && r.Method == http.MethodHead {
+						w.WriteHeader(http.StatusMethodNotAllowed)
+						return
+					}
+					w.Header().Set("ETag", `"v1"`)
+					http.ServeContent(w, r, "", time.Now(), bytes.NewReader(content))
+				}),
+			)
+			defer server.Close()
+
+			req, err := NewRequest(http.MethodGet, server.URL, nil, 512, 1)
+			assert.NoError(t, err)
+			if testCase.rangeHeader != "" {
+				req.Header.Set("Range", testCase.rangeHeader)
+			}
+
+			resp, err := Do(nil, testCase.setup(req))
+			assert.NoError(t, err)
+			defer resp.Body.Close()
+
+			if testCase.err {
+				_, err = io.ReadAll(resp.Body)
+				assert.Error(t, err)
+				return
+			}
+			assert.Equal(t, int64(len(testCase.body)), resp.ContentLength)
+			assert.NoError(t, iotest.TestReader(resp.Body, testCase.body))
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Equal(t, testCase.requests, requests)
+		})
+	}
+}
+
+func TestDo_ProbeCache(t *testing.T) {
+	content := makeData(1024)
+
+	testCases := []struct {
+		name          string
+		cacheControl  string
+		vary          string
+		noRange       bool
+		secondRequest []string
+	}{
+		{
+			name:          "cached",
+			secondRequest: []string{"GET bytes=0-511", "GET bytes=512-1023"},
+		},
+		{
+			name:          "max-age",
+			cacheControl:  "public, max-age=60",
+			secondRequest: []string{"GET bytes=0-511", "GET bytes=512-1023"},
+		},
+		{
+			name:          "no-store",
+			cacheControl:  "no-store",
+			secondRequest: []string{"HEAD ", "GET bytes=0-511", "GET bytes=512-1023"},
+		},
+		{
+			name:          "vary",
+			vary:          "X-Variant",
+			secondRequest: []string{"HEAD ", "GET bytes=0-511", "GET bytes=512-1023"},
+		},
+		{
+			name:          "no range support",
+			noRange:       true,
+			secondRequest: []string{"GET "},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var ranges []string
+			server := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					mu.Lock()
+					ranges = append(ranges, r.Method+" "+r.Header.Get("Range"))
+					mu.Unlock()
+					if testCase.cacheControl != "" {
+						w.Header().Set("Cache-Control", testCase.cacheControl)
+					}
+					if testCase.vary != "" {
+						w.Header().Set("Vary", testCase.vary)
+					}
+					if testCase.noRange {
+						_, err := w.Write(content)
+						assert.NoError(t, err)
+						return
+					}
+					http.ServeContent(w, r, "", time.Now(), bytes.NewReader(content))
+				}),
+			)
+			defer server.Close()
+
+			cache := NewProbeCache(time.Minute)
+			for i := 0; i < 2; i++ {
+				mu.Lock()
+				ranges = nil
+				mu.Unlock()
+
+				req, err := NewRequest(http.MethodGet, server.URL, nil, 512, 1)
+				assert.NoError(t, err)
+				req.Header.Set("X-Variant", strconv.Itoa(i))
+				req = req.WithProbeCache(cache).WithProbeStrategy(ProbeHead).WithOpportunisticRange()
+
+				resp, err := Do(nil, req)
+				assert.NoError(t, err)
+				assert.NoError(t, iotest.TestReader(resp.Body, content))
+				resp.Body.Close()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Equal(t, testCase.secondRequest, ranges)
+		})
+	}
+}
+
+func TestDo_ProbeCacheRangeUnsupported(t *testing.T) {
+	content := makeData(1024)
+
+	testCases := []struct {
+		name         string
+		acceptRanges string
+		// static is the requests for a static file on the same host as a
+		// dynamic endpoint that ignores range requests.
+		static []string
+	}{
+		{
+			name:   "other URLs probed",
+			static: []string{"GET bytes=0-511", "GET bytes=512-1023"},
+		},
+		{
+			name:         "accept-ranges none",
+			acceptRanges: "none",
+			static:       []string{"GET "},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var ranges []string
+			server := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					mu.Lock()
+					ranges = append(ranges, r.Method+" "+r.Header.Get("Range"))
+					mu.Unlock()
+					if r.URL.Path == "/dynamic" {
+						if testCase.acceptRanges != "" {
+							w.Header().Set("Accept-Ranges", testCase.acceptRanges)
+						}
+						_, err := w.Write(content)
+						assert.NoError(t, err)
+						return
+					}
+					http.ServeContent(w, r, "", time.Now(), bytes.NewReader(content))
+				}),
+			)
+			defer server.Close()
+
+			cache := NewProbeCache(time.Minute)
+			for _, path := range []string{"/dynamic", "/dynamic", "/static"} {
+				mu.Lock()
+				ranges = nil
+				mu.Unlock()
+
+				req, err := NewRequest(http.MethodGet, server.URL+path, nil, 512, 1)
+				assert.NoError(t, err)
+				resp, err := Do(nil, req.WithProbeCache(cache).WithOpportunisticRange())
+				assert.NoError(t, err)
+				assert.NoError(t, iotest.TestReader(resp.Body, content))
+				resp.Body.Close()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Equal(t, testCase.static, ranges)
+		})
+	}
+}
+
+func TestDo_RangeRecovery(t *testing.T) {
+	content := makeData(1024)
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Every chunk after the probe is served by a backend that ignores ranges.
+			if r.Header.Get("Range") != "bytes=0-63" {
+				r.Header.Del("Range")
+			}
+			http.ServeContent(w, r, "", time.Now(), bytes.NewReader(content))
+		}),
+	)
+	defer server.Close()
+
+	req, err := NewRequest(http.MethodGet, server.URL, nil, 64, 4)
+	assert.NoError(t, err)
+
+	resp, err := Do(nil, req)
+	assert.NoError(t, err)
+	_, err = io.ReadAll(resp.Body)
+	assert.ErrorIs(t, err, ErrRangeUnsupported)
+	resp.Body.Close()
+
+	req, err = NewRequest(http.MethodGet, server.URL, nil, 64, 4)
+	assert.NoError(t, err)
+
+	resp, err = Do(nil, req.WithRangeRecovery())
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.NoError(t, iotest.TestReader(resp.Body, content))
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	assert.Equal(t, uint64(15), getHostMetrics(host).requestChunksRangeIgnoredTotal.Get())
+}
+
+func TestDo_ContentChanged(t *testing.T) {
+	content := makeData(1024)
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// The content changes right after the probe.
+			if r.Header.Get("Range") == "bytes=0-255" {
+				w.Header().Set("ETag", `"v1"`)
+			} else {
+				w.Header().Set("ETag", `"v2"`)
+			}
+			// ServeContent honours If-Range, and sends the whole content
+			// once the ETag no longer matches.
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+		}),
+	)
+	defer server.Close()
+
+	for _, recoverRange := range []bool{false, true} {
+		req, err := NewRequest(http.MethodGet, server.URL, nil, 256, 1)
+		assert.NoError(t, err)
+		if recoverRange {
+			req = req.WithRangeRecovery()
+		}
+
+		resp, err := Do(nil, req)
+		assert.NoError(t, err)
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		var chunkErr *ChunkError
+		if assert.ErrorAs(t, err, &chunkErr) {
+			assert.Equal(t, http.StatusOK, chunkErr.StatusCode)
+		}
+		assert.ErrorIs(t, err, ErrContentChanged)
+		assert.NotErrorIs(t, err, ErrRangeUnsupported)
+	}
+}
+
+func TestDo_ChunkValidation(t *testing.T) {
+	content := makeData(1024)
+
+	testCases := []struct {
+		name     string
+		handler  func(w http.ResponseWriter, c Chunk)
+		received Chunk
+	}{
+		{
+			name: "wrong range",
+			handler: func(w http.ResponseWriter, c Chunk) {
+				c.Start--
+				w.Header().Set("Content-Range", c.ContentRangeHeader(uint64(len(content))))
+				w.WriteHeader(http.StatusPartialContent)
+				_, _ = w.Write(content[c.Start : c.Start+c.Length])
+			},
+			received: Chunk{Start: 511, Length: 512},
+		},
+		{
+			name: "truncated body",
+			handler: func(w http.ResponseWriter, c Chunk) {
+				w.Header().Set("Content-Range", c.ContentRangeHeader(uint64(len(content))))
+				w.WriteHeader(http.StatusPartialContent)
+				_, _ = w.Write(content[c.Start : c.Start+c.Length/2])
+			},
+			received: Chunk{Start: 512, Length: 256},
+		},
+		{
+			name: "long body",
+			handler: func(w http.ResponseWriter, c Chunk) {
+				w.Header().Set("Content-Range", c.ContentRangeHeader(uint64(len(content))))
+				w.WriteHeader(http.StatusPartialContent)
+				_, _ = w.Write(content[c.Start-1 : c.Start+c.Length])
+			},
+			received: Chunk{Start: 512, Length: 513},
+		},
+		{
+			name: "wrong size",
+			handler: func(w http.ResponseWriter, c Chunk) {
+				w.Header().Set("Content-Range", c.ContentRangeHeader(uint64(len(content))+1))
+				w.WriteHeader(http.StatusPartialContent)
+				_, _ = w.Write(content[c.Start : c.Start+c.Length])
+			},
+			received: Chunk{Start: 512, Length: 512},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if rng := r.Header.Get("Range"); rng != "bytes=0-511" {
+						cs, err := ParseRange(rng, uint64(len(content)))
+						assert.NoError(t, err)
+						testCase.handler(w, cs[0])
+						return
+					}
+					http.ServeContent(w, r, "", time.Now(), bytes.NewReader(content))
+				}),
+			)
+			defer server.Close()
+
+			req, err := NewRequest(http.MethodGet, server.URL, nil, 512, 1)
+			assert.NoError(t, err)
+
+			resp, err := Do(nil, req)
+			assert.NoError(t, err)
+			defer resp.Body.Close()
+
+			_, err = io.ReadAll(resp.Body)
+			var rangeErr *RangeMismatchError
+			if assert.ErrorAs(t, err, &rangeErr) {
+				assert.Equal(t, Chunk{Start: 512, Length: 512}, rangeErr.Requested)
+				assert.Equal(t, testCase.received, rangeErr.Received)
+			}
+		})
+	}
+}
+
+func TestDo_Errors(t *testing.T) {
+	content := makeData(1024)
+	// The chunks at 64 and 128 fail. The first one fails once the second one
+	// has been requested, and the second one well after the first one.
+	first, second := make(chan struct{}), make(chan struct{})
+	handler := &contentServer{content: content, hook: func(w http.ResponseWriter, r *http.Request) bool {
+		switch rangeVal := r.Header.Get("Range"); {
+		case rangeVal == "bytes=64-127":
+			<-second
+			defer close(first)
+		case rangeVal == "bytes=128-191":
+			close(second)
+			<-first
+			time.Sleep(50 * time.Millisecond)
+		case r.URL.Path != "/missing":
+			return false
+		}
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return true
+	}}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	req, err := NewRequest(http.MethodGet, server.URL+"/missing", nil, 64, 4)
+	assert.NoError(t, err)
+	req.Header.Set("Range", "bytes=100-")
+	_, err = Do(nil, req)
+	var probeErr *ProbeError
+	if assert.ErrorAs(t, err, &probeErr) {
+		assert.Equal(t, server.URL+"/missing", probeErr.URL)
+		assert.Equal(t, http.StatusServiceUnavailable, probeErr.StatusCode)
+	}
+
+	req, err = NewRequest(http.MethodGet, server.URL, nil, 64, 4)
+	assert.NoError(t, err)
+	resp, err := Do(nil, req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	_, err = io.ReadAll(resp.Body)
+	var chunkErr *ChunkError
+	if assert.ErrorAs(t, err, &chunkErr) {
+		assert.Equal(t, Chunk{64, 64}, chunkErr.Chunk)
+		assert.Equal(t, server.URL, chunkErr.URL)
+		assert.Equal(t, 1, chunkErr.Attempt)
+		assert.Equal(t, http.StatusServiceUnavailable, chunkErr.StatusCode)
+		assert.Equal(t, "1", chunkErr.Header.Get("Retry-After"))
+		assert.ErrorIs(t, err, ErrRangeUnsupported)
+	}
+	// Both failed chunks are reported.
+	var chunkErrs ChunkErrors
+	assert.ErrorAs(t, err, &chunkErrs)
+	assert.Len(t, chunkErrs, 2)
+	for i, err := range chunkErrs {
+		assert.Equal(t, uint64(64*(i+1)), err.Chunk.Start)
+		assert.Equal(t, http.StatusServiceUnavailable, err.StatusCode)
+	}
+}
+
+func TestChunkErrors(t *testing.T) {
+	first := &ChunkError{Chunk: Chunk{0, 10}, URL: "http://example.com", Err: ErrRangeUnsupported}
+	second := &ChunkError{Chunk: Chunk{10, 10}, URL: "http://example.com", Err: io.ErrUnexpectedEOF}
+
+	assert.NoError(t, ChunkErrors{}.err())
+	assert.Equal(t, first, ChunkErrors{first}.err())
+
+	err := ChunkErrors{first, second}.err()
+	assert.ErrorIs(t, err, ErrRangeUnsupported)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	var chunkErr *ChunkError
+	assert.ErrorAs(t, err, &chunkErr)
+	assert.Equal(t, first, chunkErr)
+}
+
+func TestDo_UnknownSize(t *testing.T) {
+	testCases := []struct {
+		name         string
+		size         int
+		rangeHeader  string
+		start        int
+		contentRange string
+		statusCode   int
+	}{
+		{name: "smaller than a chunk", size: 100, statusCode: http.StatusOK},
+		{name: "multiple of chunk size", size: 1024, statusCode: http.StatusOK},
+		{name: "short last chunk", size: 1000, statusCode: http.StatusOK},
+		{
+			name:        "open range",
+			size:        1000,
+			rangeHeader: "bytes=100-",
+			start:       100,
+			statusCode:  http.StatusPartialContent,
+		},
+		{
+			name:         "closed range",
+			size:         1000,
+			rangeHeader:  "bytes=100-199",
+			start:        100,
+			contentRange: "bytes 100-199/*",
+			statusCode:   http.StatusPartialContent,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			content := makeData(testCase.size)
+			server := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					// Serve content as if it was being generated, without a known size.
+					cs, err := ParseRange(r.Header.Get("Range"), uint64(len(content)))
+					if err != nil {
+						w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+						return
+					}
+					c := cs[0]
+					w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", c.Start, c.Start+c.Length-1))
+					w.WriteHeader(http.StatusPartialContent)
+					_, _ = w.Write(content[c.Start : c.Start+c.Length])
+				}),
+			)
+			defer server.Close()
+
+			req, err := NewRequest(http.MethodGet, server.URL, nil, 128, 4)
+			assert.NoError(t, err)
+			if testCase.rangeHeader != "" {
+				req.Header.Set("Range", testCase.rangeHeader)
+			}
+
+			resp, err := Do(nil, req)
+			assert.NoError(t, err)
+			defer resp.Body.Close()
+
+			assert.Equal(t, testCase.statusCode, resp.StatusCode)
+			assert.Equal(t, int64(-1), resp.ContentLength)
+			assert.Equal(t, testCase.contentRange, resp.Header.Get("Content-Range"))
+
+			want := content[testCase.start:]
+			if testCase.contentRange != "" {
+				want = content[100:200]
+			}
+			assert.NoError(t, iotest.TestReader(resp.Body, want))
+		})
+	}
+}
+
+func TestDo_ContentEncoding(t *testing.T) {
+	content := makeData(1024)
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	_, err := zw.Write(content)
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Serve ranges of the gzip encoded content if the client accepts it.
+			if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+				w.Header().Set("Content-Encoding", "gzip")
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(gzipped.Bytes()))
+				return
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+		}),
+	)
+	defer server.Close()
+
+	// Ask for the unencoded content.
+	req, err := NewRequest(http.MethodGet, server.URL, nil, 64, 4)
+	assert.NoError(t, err)
+	resp, err := Do(nil, req)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(content)), resp.ContentLength)
+	assert.NoError(t, iotest.TestReader(resp.Body, content))
+	resp.Body.Close()
+
+	// Decode the encoded content.
+	req, err = NewRequest(http.MethodGet, server.URL, nil, 64, 4)
+	assert.NoError(t, err)
+	resp, err = Do(nil, req.WithContentDecoding())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1), resp.ContentLength)
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.NoError(t, iotest.TestReader(resp.Body, content))
+	resp.Body.Close()
+
+	// Ask for the encoded content.
+	req, err = NewRequest(http.MethodGet, server.URL, nil, 64, 4)
+	assert.NoError(t, err)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err = Do(nil, req)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(gzipped.Len()), resp.ContentLength)
+	assert.NoError(t, iotest.TestReader(resp.Body, gzipped.Bytes()))
+	resp.Body.Close()
+}
+
+func TestDo_EncodedRanges(t *testing.T) {
+	content := makeData(1024)
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Encode the content no matter what the client asks for.
+			w.Header().Set("Content-Encoding", "gzip")
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+		}),
+	)
+	defer server.Close()
+
+	req, err := NewRequest(http.MethodGet, server.URL, nil, 64, 4)
+	assert.NoError(t, err)
+	_, err = Do(nil, req)
+	assert.ErrorIs(t, err, ErrEncodedRange)
+}
+
+func TestDo_EncodedWholeContent(t *testing.T) {
+	content := makeData(1024)
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	_, err := zw.Write(content)
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Ignore ranges, and encode the content no matter what the client asks for.
+			w.Header().Set("Content-Encoding", "gzip")
+			_, _ = w.Write(gzipped.Bytes())
+		}),
+	)
+	defer server.Close()
+
+	tests := []struct {
+		name  string
+		setup func(*Request) *Request
+		want  []byte
+	}{
+		{name: "decoded", setup: func(r *Request) *Request { return r }, want: content},
+		{name: "content decoding", setup: func(r *Request) *Request { return r.WithContentDecoding() }, want: content},
+		{
+			name: "encoding asked for",
+			setup: func(r *Request) *Request {
+				r.Header.Set("Accept-Encoding", "gzip")
+				return r
+			},
+			want: gzipped.Bytes(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := NewRequest(http.MethodGet, server.URL, nil, 64, 4)
+			assert.NoError(t, err)
+			resp, err := Do(nil, tt.setup(req).WithOpportunisticRange())
+			assert.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.NoError(t, iotest.TestReader(resp.Body, tt.want))
+		})
+	}
+}
+
+func TestDo_ReadAhead(t *testing.T) {
+	content := makeData(1000)
+
+	var mu sync.Mutex
+	var maxEnd uint64
+	attempts := make(map[string]int)
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rangeVal := r.Header.Get("Range")
+			mu.Lock()
+			attempts[rangeVal]++
+			first := attempts[rangeVal] == 1
+			if cs, err := ParseRange(rangeVal, uint64(len(content))); err == nil && len(cs) == 1 {
+				maxEnd = max(maxEnd, cs[0].Start+cs[0].Length)
+			}
+			mu.Unlock()
+
+			if rangeVal == "bytes=60-69" && first {
+				// Stall the first request for this chunk until it's cancelled.
+				<-r.Context().Done()
+				return
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+		}),
+	)
+	defer server.Close()
+
+	requestedUpTo := func() uint64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return maxEnd
+	}
+
+	req, err := NewRequest(http.MethodGet, server.URL, nil, 10, 8)
+	assert.NoError(t, err)
+	resp, err := Do(nil, req.WithReadAhead(30, 20*time.Millisecond))
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	// Nothing is fetched past the window.
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, uint64(30), requestedUpTo())
+
+	buf := make([]byte, 50)
+	_, err = io.ReadFull(resp.Body, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, content[:50], buf)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, uint64(80), requestedUpTo())
+
+	// The stalled chunk is hedged.
+	rest, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, content[50:], rest)
+	mu.Lock()
+	assert.Equal(t, 2, attempts["bytes=60-69"])
+	mu.Unlock()
+}
+
 func TestDo_ChunkRequestNotSupportedButSucceedAnyway(t *testing.T) {
 	content := makeData(1024)
 	server := httptest.NewServer(
@@ -496,3 +1287,95 @@ func makeHttptestServer(content []byte) *httptest.Server {
 		}),
 	)
 }
+
+// contentServer serves content, with etag if set, and records the requests it
+// gets. Tests give it behaviour of their own with hook.
+type contentServer struct {
+	// hook, if not nil, is called with every request before the content is
+	// served. It can set headers of the response, or answer the request
+	// itself, like with a redirect, an error, or a stall, and then returns true.
+	// It's called concurrently.
+	hook func(w http.ResponseWriter, r *http.Request) bool
+
+	mu       sync.Mutex
+	content  []byte
+	etag     string
+	requests []*http.Request
+}
+
+func (s *contentServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Clone(context.Background()))
+	content, etag := s.content, s.etag
+	s.mu.Unlock()
+
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if s.hook != nil && s.hook(w, r) {
+		return
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+}
+
+// change replaces the content and its ETag.
+func (s *contentServer) change(content []byte, etag string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.content, s.etag = content, etag
+}
+
+// requested returns the requests recorded since the last reset.
+func (s *contentServer) requested() []*http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*http.Request(nil), s.requests...)
+}
+
+// ranges returns the Range headers of the requests recorded since the last reset.
+func (s *contentServer) ranges() []string {
+	var ranges []string
+	for _, r := range s.requested() {
+		ranges = append(ranges, r.Header.Get("Range"))
+	}
+	return ranges
+}
+
+// reset forgets the requests recorded so far.
+func (s *contentServer) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = nil
+}
+
+// answerFirst returns a hook that answers the first n requests for chunks
+// starting in [from, to) with answer, and leaves the others to be served.
+func answerFirst(
+	n int,
+	from, to uint64,
+	answer func(w http.ResponseWriter, r *http.Request, c Chunk),
+) func(http.ResponseWriter, *http.Request) bool {
+	var mu sync.Mutex
+	return func(w http.ResponseWriter, r *http.Request) bool {
+		cs, err := ParseRange(r.Header.Get("Range"), math.MaxInt64)
+		if err != nil || len(cs) != 1 || cs[0].Start < from || cs[0].Start >= to {
+			return false
+		}
+		mu.Lock()
+		answered := n > 0
+		n--
+		mu.Unlock()
+		if answered {
+			answer(w, r, cs[0])
+		}
+		return answered
+	}
+}
+
+// failFirst returns a hook that fails the first n requests for the chunk
+// starting at start with status.
+func failFirst(n int, start uint64, status int) func(http.ResponseWriter, *http.Request) bool {
+	return answerFirst(n, start, start+1, func(w http.ResponseWriter, _ *http.Request, _ Chunk) {
+		w.WriteHeader(status)
+	})
+}
@@ -7,6 +7,7 @@ package chonker
 import (
 	"errors"
 	"fmt"
+	"math"
 	"net/textproto"
 	"strconv"
 	"strings"
@@ -24,6 +25,10 @@ var (
 	ErrUnsatisfiedRange = errors.New("chonker: unsatisfied range")
 )
 
+// UnknownSize is the size returned by ParseContentRange when the server
+// does not know the complete length of the content.
+const UnknownSize uint64 = math.MaxUint64
+
 // Chunk represents a byte range.
 type Chunk struct {
 	Start  uint64
@@ -153,6 +158,7 @@ func ParseRange(s string, size uint64) ([]Chunk, error) {
 
 // ParseContentRange parses a Content-Range header string as per [RFC 7233].
 // It returns the chunk describing the returned content range, and the size of the content.
+// If the complete length is unknown ("*"), the size is UnknownSize.
 // ErrUnsatisfiedRange is returned if the range is not satisfied.
 //
 // [RFC 7233]: https://tools.ietf.org/html/rfc7233#section-4.2
@@ -166,12 +172,22 @@ func ParseContentRange(s string) (*Chunk, uint64, error) {
 	if !ok {
 		return nil, 0, ErrInvalidRange
 	}
-	size, err := strconv.ParseInt(a, 10, 64)
-	if err != nil {
-		return nil, 0, err
+	size := UnknownSize
+	if a != "*" {
+		sz, err := strconv.ParseInt(a, 10, 64)
+		if err != nil {
+			return nil, 0, err
+		}
+		if sz < 0 {
+			return nil, 0, ErrInvalidRange
+		}
+		size = uint64(sz)
 	}
 	if b == "*" {
-		return nil, uint64(size), ErrUnsatisfiedRange
+		if size == UnknownSize {
+			return nil, 0, ErrInvalidRange
+		}
+		return nil, size, ErrUnsatisfiedRange
 	}
 
 	b, a, ok = strings.Cut(b, "-")
@@ -187,7 +203,7 @@ func ParseContentRange(s string) (*Chunk, uint64, error) {
 	if err != nil {
 		return nil, 0, err
 	}
-	if start > end || end > size {
+	if start > end || uint64(end) > size {
 		return nil, 0, ErrInvalidRange
 	}
 
@@ -196,7 +212,7 @@ func ParseContentRange(s string) (*Chunk, uint64, error) {
 		Length: uint64(end - start + 1),
 	}
 
-	return c, uint64(size), nil
+	return c, size, nil
 }
 
 // index returns the index of the chunk containing the given offset.
@@ -325,6 +325,20 @@ var parseContentRangeTests = []struct {
 		size:    500,
 		wantErr: true,
 	},
+	{
+		name: "unknown size",
+		s:    "bytes 0-0/*",
+		size: UnknownSize,
+		want: &Chunk{
+			Start:  0,
+			Length: 1,
+		},
+	},
+	{
+		name:    "unsatisfied range of unknown size",
+		s:       "bytes */*",
+		wantErr: true,
+	},
 }
 
 func TestParseContentRange(t *testing.T) {
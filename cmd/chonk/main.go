@@ -4,11 +4,16 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"os/signal"
+	"path"
+	"path/filepath"
 	"time"
 
 	"github.com/ananthb/chonker"
+	"github.com/ananthb/chonker/objstore"
 	"github.com/cavaliergopher/grab/v3"
 	"github.com/dustin/go-humanize"
 	"golang.org/x/term"
@@ -17,6 +22,8 @@ import (
 var (
 	chunkSize       string
 	continueNoRange bool
+	follow          bool
+	followInterval  time.Duration
 	metricsFile     string
 	outputFile      string
 	quiet           bool
@@ -29,6 +36,8 @@ var (
 func init() {
 	flag.StringVar(&chunkSize, "c", "1MiB", "chunk size (e.g. 1MiB, 1GiB)")
 	flag.BoolVar(&continueNoRange, "continue", false, "continue download without range support")
+	flag.BoolVar(&follow, "follow", false, "keep downloading as the remote file grows, like tail -f")
+	flag.DurationVar(&followInterval, "interval", time.Second, "poll interval in follow mode")
 	flag.StringVar(&metricsFile, "m", "", "write prometheus metrics to file (default: disabled)")
 	flag.StringVar(&outputFile, "o", "", "output file or directory (default: current directory)")
 	flag.BoolVar(&quiet, "q", false, "quiet")
@@ -54,6 +63,10 @@ func main() {
 	}
 
 	url := flag.Arg(0)
+	if follow && objstore.IsURI(url) {
+		// Objects in S3 and GCS are replaced whole, and never grow.
+		exit(fmt.Errorf("-follow does not support %s: objects in object stores never grow", url))
+	}
 
 	// Write prometheus metrics periodically
 	var metricsTicker *time.Ticker
@@ -68,6 +81,31 @@ func main() {
 		}()
 	}
 
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	if follow {
+		if err := followURL(ctx, url, csize); err != nil {
+			exit(err)
+		}
+		if metricsTicker != nil {
+			metricsTicker.Stop()
+			writeMetricsFile(metricsFile)
+		}
+		return
+	}
+
+	if objstore.IsURI(url) {
+		if err := getObject(ctx, url, csize); err != nil {
+			exit(err)
+		}
+		if metricsTicker != nil {
+			metricsTicker.Stop()
+			writeMetricsFile(metricsFile)
+		}
+		return
+	}
+
 	cc, err := chonker.NewClient(nil, csize, workers)
 	if err != nil {
 		exit(err)
@@ -76,9 +114,6 @@ func main() {
 	gc := grab.NewClient()
 	gc.HTTPClient = cc
 
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
-	defer cancel()
-
 	req, err := grab.NewRequest(outputFile, url)
 	if err != nil {
 		exit(err)
@@ -145,6 +180,90 @@ func main() {
 	}
 }
 
+// followURL writes the content at url to the output file, or to standard output
+// if there is none, and keeps writing content appended to it until ctx is done.
+func followURL(ctx context.Context, url string, chunkSize uint64) error {
+	req, err := chonker.NewRequestWithContext(ctx, http.MethodGet, url, nil, chunkSize, workers)
+	if err != nil {
+		return err
+	}
+	if continueNoRange {
+		req = req.WithOpportunisticRange()
+	}
+
+	out := os.Stdout
+	if outputFile != "" {
+		out, err = os.OpenFile(outputFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+
+	body, err := chonker.Follow(nil, req, followInterval)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if _, err := io.Copy(out, body); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+// getObject writes the object named by an s3:// or gs:// uri to the output file,
+// or to a file named after its key in the output directory.
+// Credentials are read from the environment, see objstore.ConfigFromEnv.
+func getObject(ctx context.Context, uri string, chunkSize uint64) error {
+	scheme, _, key, err := objstore.ParseURI(uri)
+	if err != nil {
+		return err
+	}
+	client, err := objstore.NewClientFromEnv(nil, scheme)
+	if err != nil {
+		return err
+	}
+
+	filename := outputFile
+	if fi, err := os.Stat(outputFile); outputFile == "" || err == nil && fi.IsDir() {
+		filename = filepath.Join(outputFile, path.Base(key))
+	}
+
+	if !quiet {
+		fmt.Printf("Downloading %s\n", uri)
+	}
+	start := time.Now()
+	resp, err := client.Get(ctx, uri, chunkSize, workers)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	out, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(out, resp.Body)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if !quiet {
+		elapsed := time.Since(start)
+		fmt.Printf(
+			"Downloaded %s in %s at %s/s.\n",
+			humanize.IBytes(uint64(n)),
+			elapsed.Round(time.Second),
+			humanize.IBytes(uint64(float64(n)/elapsed.Seconds())),
+		)
+	}
+	return nil
+}
+
 func exit(msg any) {
 	if !quiet {
 		fmt.Fprintln(os.Stderr, msg)
@@ -0,0 +1,289 @@
+package chonker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// ConnectionStrategy is the way chunks are spread over connections.
+type ConnectionStrategy int
+
+const (
+	// ConnectionsMultiplex fetches chunks over the connections of the client,
+	// which multiplexes concurrent chunks over a single connection with HTTP/2.
+	// This is the default.
+	ConnectionsMultiplex ConnectionStrategy = iota
+	// ConnectionsAuto fetches chunks over separate connections if the probe
+	// negotiated HTTP/2 or later, and like ConnectionsMultiplex otherwise.
+	// Separate connections are made for every download, so they only pay off
+	// for large content.
+	ConnectionsAuto
+	// ConnectionsSeparate fetches chunks over several separate connections,
+	// to get around per-connection throughput limits of servers.
+	// Like ConnectionsAuto, it makes connections for every download.
+	ConnectionsSeparate
+)
+
+// MarshalText returns "multiplex", "auto", or "separate".
+func (s ConnectionStrategy) MarshalText() ([]byte, error) {
+	switch s {
+	case ConnectionsMultiplex:
+		return []byte("multiplex"), nil
+	case ConnectionsAuto:
+		return []byte("auto"), nil
+	case ConnectionsSeparate:
+		return []byte("separate"), nil
+	default:
+		return nil, fmt.Errorf("chonker: unknown connection strategy %d", s)
+	}
+}
+
+// UnmarshalText parses "multiplex", "auto", or "separate".
+func (s *ConnectionStrategy) UnmarshalText(text []byte) error {
+	switch strings.ToLower(string(text)) {
+	case "multiplex":
+		*s = ConnectionsMultiplex
+	case "auto":
+		*s = ConnectionsAuto
+	case "separate":
+		*s = ConnectionsSeparate
+	default:
+		return fmt.Errorf("chonker: unknown connection strategy %q", text)
+	}
+	return nil
+}
+
+// Connections configures the connections chunks are fetched over.
+type Connections struct {
+	Strategy ConnectionStrategy
+	// Count is the number of separate connections.
+	// It defaults to the number of workers.
+	Count int
+	// NewTransport returns a transport with connections of its own, for
+	// transports other than http.Transport, like HTTP/3 transports.
+	// If nil, the http.Transport of the client is cloned. Clients with other
+	// transports then multiplex chunks.
+	NewTransport func() http.RoundTripper
+	// LocalAddrs are local addresses that separate connections are made from,
+	// in turn, to spread chunks over network interfaces and get around
+	// per-address limits of servers. Each address is used for servers of the
+	// same address family. Setting LocalAddrs implies ConnectionsSeparate.
+	// Only transports that are http.Transports can be bound to local addresses.
+	LocalAddrs []net.IP
+	// Interfaces are names of network interfaces, like "eth1", whose
+	// addresses are added to LocalAddrs.
+	Interfaces []string
+	// Resolver, if not nil, resolves the host of the request once, and chunks
+	// are spread over separate connections to all of its addresses.
+	// See Resolver for details. Configs loaded with LoadConfig or
+	// ConfigFromEnv use net.DefaultResolver to fan out.
+	Resolver Resolver
+}
+
+// localAddrs returns LocalAddrs and the addresses of Interfaces.
+func (c Connections) localAddrs() ([]net.IP, error) {
+	addrs := append([]net.IP(nil), c.LocalAddrs...)
+	for _, name := range c.Interfaces {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, err
+		}
+		ifaceAddrs, err := iface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("chonker: error listing addresses of %s: %w", name, err)
+		}
+		for _, a := range ifaceAddrs {
+			if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.IsGlobalUnicast() || ok && ipNet.IP.IsLoopback() {
+				addrs = append(addrs, ipNet.IP)
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// WithConnections configures how the chunks of r are spread over connections.
+// See Connections for details.
+func (r *Request) WithConnections(c Connections) *Request {
+	r.connections = c
+	return r
+}
+
+// connPool is the clients that the chunks of a request are fetched with in
+// turn, each over connections of its own.
+type connPool struct {
+	clients []*http.Client
+	// edges are the server addresses that the clients connect to, if the
+	// request fans out over the addresses of its host.
+	edges []*edge
+	next  atomic.Uint64
+}
+
+// connPool returns the clients that chunks are fetched with, given the
+// client c and the response to the probe, if any.
+// With separate connections, each client has a transport of its own.
+// Otherwise, it returns nil, and chunks are fetched with c.
+func (r *Request) connPool(c *http.Client, probeResp *http.Response) *connPool {
+	conns := r.connections
+	localAddrs, err := conns.localAddrs()
+	if err != nil {
+		r.logger().Warn("chonker: error finding local addresses", "url", r.URL.String(), "error", err)
+	}
+	u := r.URL
+	if probeResp != nil && probeResp.Request != nil {
+		u = probeResp.Request.URL
+	}
+	edges := r.resolveEdges(u)
+	switch {
+	case len(localAddrs) > 0 || len(edges) > 0:
+	case conns.Strategy == ConnectionsMultiplex:
+		return nil
+	case conns.Strategy == ConnectionsAuto && (probeResp == nil || probeResp.ProtoMajor < 2):
+		return nil
+	}
+
+	newTransport := conns.NewTransport
+	if newTransport == nil {
+		base, ok := transport(c).(*http.Transport)
+		if !ok {
+			r.logger().Debug("chonker: can't clone transport for separate connections",
+				"url", r.URL.String(), "transport", fmt.Sprintf("%T", c.Transport))
+			return nil
+		}
+		newTransport = func() http.RoundTripper { return base.Clone() }
+	}
+
+	n := conns.Count
+	if n <= 0 {
+		n = int(r.workers)
+	}
+	n = max(n, len(localAddrs), len(edges))
+	pool := &connPool{clients: make([]*http.Client, n), edges: make([]*edge, n)}
+	for i := range pool.clients {
+		t := newTransport()
+		if ht, ok := t.(*http.Transport); ok {
+			if len(localAddrs) > 0 {
+				addr := localAddrs[i%len(localAddrs)]
+				bindTransport(ht, addr)
+				t = &sourceTransport{RoundTripper: t, source: addr.String()}
+			}
+			if len(edges) > 0 {
+				e := edges[i%len(edges)]
+				pinTransport(ht, u.Host, e.addr)
+				t = &edgeTransport{RoundTripper: t, edge: e}
+				pool.edges[i] = e
+			}
+		}
+		pool.clients[i] = &http.Client{
+			Transport:     t,
+			CheckRedirect: c.CheckRedirect,
+			Jar:           c.Jar,
+			Timeout:       c.Timeout,
+		}
+	}
+	return pool
+}
+
+// client returns the client to fetch the next chunk with.
+// Clients connected to demoted edges are skipped, except for one in every
+// demotedEdgeTurns of their turns, so that they can recover.
+func (p *connPool) client() *http.Client {
+	n := uint64(len(p.clients))
+	for range p.clients {
+		turn := p.next.Add(1)
+		e := p.edges[turn%n]
+		if e == nil || !p.demoted(e) || turn/n%demotedEdgeTurns == 0 {
+			return p.clients[turn%n]
+		}
+	}
+	return p.clients[p.next.Add(1)%n]
+}
+
+// closeIdleConnections closes the idle connections of the clients,
+// which aren't used after the chunks have been fetched.
+func (p *connPool) closeIdleConnections() {
+	for _, c := range p.clients {
+		c.CloseIdleConnections()
+	}
+}
+
+// chunkClient returns the client to fetch the next chunk with.
+func (r *remoteFileReader) chunkClient() *http.Client {
+	if r.conns == nil {
+		return r.client
+	}
+	return r.conns.client()
+}
+
+// bindTransport makes t connect from the local address addr to servers of
+// the same address family.
+func bindTransport(t *http.Transport, addr net.IP) {
+	dial := t.DialContext
+	if dial == nil {
+		dial = defaultDialer.DialContext
+	}
+	bound := &net.Dialer{
+		Timeout:   defaultDialer.Timeout,
+		KeepAlive: defaultDialer.KeepAlive,
+		LocalAddr: &net.TCPAddr{IP: addr},
+	}
+	t.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := bound.DialContext(ctx, network, address)
+		var addrErr *net.AddrError
+		if errors.As(err, &addrErr) {
+			// The server has no address of the family of addr.
+			return dial(ctx, network, address)
+		}
+		return conn, err
+	}
+}
+
+// defaultDialer dials like the dialer of http.DefaultTransport.
+var defaultDialer = &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+
+// sourceTransport counts the bytes read from responses by source address.
+type sourceTransport struct {
+	http.RoundTripper
+	source string
+}
+
+func (t *sourceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	m := getSourceMetrics(req.URL.Host, t.source)
+	resp.Body = &measuredBody{ReadCloser: resp.Body, bytes: m.bytesTotal, seconds: m.readSecondsTotal}
+	return resp, nil
+}
+
+// CloseIdleConnections closes the idle connections of the wrapped transport.
+func (t *sourceTransport) CloseIdleConnections() {
+	if c, ok := t.RoundTripper.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// measuredBody counts the bytes read from a response body,
+// and the time spent reading them.
+type measuredBody struct {
+	io.ReadCloser
+	bytes   *metrics.Counter
+	seconds *metrics.FloatCounter
+}
+
+func (b *measuredBody) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := b.ReadCloser.Read(p)
+	b.bytes.Add(n)
+	b.seconds.Add(time.Since(start).Seconds())
+	return n, err
+}
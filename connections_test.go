@@ -0,0 +1,113 @@
+package chonker
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDo_Connections(t *testing.T) {
+	tests := []struct {
+		name  string
+		http2 bool
+		conns Connections
+		// newTransport sets Connections.NewTransport to clone the transport
+		// of the test client.
+		newTransport bool
+		minAddrs     int
+		maxAddrs     int
+	}{
+		{name: "default http2", http2: true, minAddrs: 1, maxAddrs: 1},
+		{name: "auto http2", http2: true, conns: Connections{Strategy: ConnectionsAuto}, minAddrs: 4, maxAddrs: 5},
+		{name: "multiplex http2", http2: true, conns: Connections{Strategy: ConnectionsMultiplex}, minAddrs: 1, maxAddrs: 1},
+		{name: "separate http2", http2: true, conns: Connections{Strategy: ConnectionsSeparate, Count: 2}, minAddrs: 2, maxAddrs: 3},
+		{
+			name:         "separate new transport",
+			http2:        true,
+			conns:        Connections{Strategy: ConnectionsSeparate, Count: 3},
+			newTransport: true,
+			minAddrs:     3,
+			maxAddrs:     4,
+		},
+		{name: "auto http1", conns: Connections{Strategy: ConnectionsAuto}, minAddrs: 1, maxAddrs: 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := makeData(1000)
+			handler := &contentServer{content: content}
+			server := httptest.NewUnstartedServer(handler)
+			server.EnableHTTP2 = tt.http2
+			server.StartTLS()
+			defer server.Close()
+
+			client := server.Client()
+			if tt.newTransport {
+				tt.conns.NewTransport = func() http.RoundTripper {
+					return client.Transport.(*http.Transport).Clone()
+				}
+			}
+			req, err := NewRequest(http.MethodGet, server.URL, nil, 100, 4)
+			assert.NoError(t, err)
+			resp, err := Do(client, req.WithConnections(tt.conns))
+			assert.NoError(t, err)
+			defer resp.Body.Close()
+			got, err := io.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, content, got)
+
+			addrs, protos := map[string]bool{}, map[int]bool{}
+			for _, r := range handler.requested() {
+				addrs[r.RemoteAddr] = true
+				protos[r.ProtoMajor] = true
+			}
+			if tt.http2 {
+				assert.Equal(t, map[int]bool{2: true}, protos)
+			} else {
+				assert.Equal(t, map[int]bool{1: true}, protos)
+			}
+			assert.GreaterOrEqual(t, len(addrs), tt.minAddrs)
+			assert.LessOrEqual(t, len(addrs), tt.maxAddrs)
+		})
+	}
+}
+
+func TestDo_LocalAddrs(t *testing.T) {
+	// Only some systems, like Linux, route all of 127.0.0.0/8 to loopback.
+	l, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skip("127.0.0.2 is not a loopback address here:", err)
+	}
+	l.Close()
+
+	content := makeData(1000)
+	handler := &contentServer{content: content}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	host := server.Listener.Addr().String()
+	before := getSourceMetrics(host, "127.0.0.2").bytesTotal.Get()
+
+	req, err := NewRequest(http.MethodGet, server.URL, nil, 100, 4)
+	assert.NoError(t, err)
+	req = req.WithConnections(Connections{LocalAddrs: []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.2")}})
+	resp, err := Do(nil, req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	got, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, content, got)
+
+	sources := map[string]int{}
+	for _, r := range handler.requested() {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		sources[host]++
+	}
+	assert.Len(t, sources, 2)
+	assert.Positive(t, sources["127.0.0.2"])
+	assert.Equal(t, uint64(100*sources["127.0.0.2"]), getSourceMetrics(host, "127.0.0.2").bytesTotal.Get()-before)
+}
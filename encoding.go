@@ -0,0 +1,138 @@
+package chonker
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	headerNameAcceptEncoding  = "Accept-Encoding"
+	headerNameContentEncoding = "Content-Encoding"
+)
+
+// ErrEncodedRange is returned when a server sends ranges of an encoded
+// (e.g. gzip compressed) representation of the content although the
+// unencoded representation was requested.
+// Ranges of an encoded representation can't be decoded independently.
+// See Request.WithContentDecoding to fetch and decode them anyway.
+var ErrEncodedRange = errors.New("chonker: server sent encoded ranges")
+
+// WithContentDecoding configures r to fetch the gzip or deflate encoded
+// representation of the content in chunks, and to decode the reassembled stream.
+// Content-Length and Content-Encoding headers are removed from the response,
+// which reports an unknown content length.
+// Range headers on r refer to the encoded representation.
+//
+// By default, chonker fetches the unencoded representation of the content,
+// unless the Accept-Encoding header is set on r.
+func (r *Request) WithContentDecoding() *Request {
+	r.decodeContent = true
+	return r
+}
+
+// setAcceptEncoding sets the Accept-Encoding header of a sub-request of r.
+// Unless the request asks for an encoding, sub-requests ask for the unencoded
+// representation so that chunks are byte ranges of the content as-is.
+// Setting the header also stops http.Transport from decompressing responses
+// behind our back.
+func (r *Request) setAcceptEncoding(h http.Header) {
+	switch {
+	case r.decodeContent:
+		h.Set(headerNameAcceptEncoding, "gzip, deflate")
+	case h.Get(headerNameAcceptEncoding) == "":
+		h.Set(headerNameAcceptEncoding, "identity")
+	}
+}
+
+// checkEncoding returns ErrEncodedRange if the header h of a partial response
+// to a sub-request of r shows an encoding that was not asked for.
+// Responses with the whole content are decoded with decodeWholeBody instead.
+func (r *Request) checkEncoding(h http.Header) error {
+	if r.decodeContent || r.Header.Get(headerNameAcceptEncoding) != "" {
+		return nil
+	}
+	if enc := contentEncoding(h); enc != "" {
+		return fmt.Errorf("%w: got Content-Encoding %s", ErrEncodedRange, enc)
+	}
+	return nil
+}
+
+// contentEncoding returns the Content-Encoding in h, or an empty string if
+// the content is not encoded.
+func contentEncoding(h http.Header) string {
+	enc := strings.ToLower(strings.TrimSpace(h.Get(headerNameContentEncoding)))
+	if enc == "identity" {
+		return ""
+	}
+	return enc
+}
+
+// decodeWholeBody decodes resp, a response to a sub-request of r with the
+// whole content, if r asked for decoded content, or for no encoding at all,
+// like http.Transport does for requests without an Accept-Encoding header.
+// Unless r asked for decoded content, content in encodings that can't be
+// decoded is left as-is.
+func (r *Request) decodeWholeBody(resp *http.Response) error {
+	if !r.decodeContent && r.Header.Get(headerNameAcceptEncoding) != "" {
+		return nil
+	}
+	if err := decodeBody(resp); err != nil && r.decodeContent {
+		return err
+	}
+	return nil
+}
+
+// decodeBody wraps the body of resp with a decoder for its Content-Encoding,
+// and updates its headers to describe the decoded content.
+// If the content is not encoded, resp is left as-is.
+func decodeBody(resp *http.Response) error {
+	var newReader func(io.Reader) (io.ReadCloser, error)
+	switch enc := contentEncoding(resp.Header); enc {
+	case "":
+		return nil
+	case "gzip", "x-gzip":
+		newReader = func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) }
+	case "deflate":
+		newReader = zlib.NewReader
+	default:
+		return fmt.Errorf("chonker: unsupported Content-Encoding %s", enc)
+	}
+
+	resp.Body = &decodingBody{body: resp.Body, newReader: newReader}
+	resp.Header.Del(headerNameContentEncoding)
+	resp.Header.Del(headerNameContentLength)
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+// decodingBody decodes an encoded response body.
+// The decoder is created on the first read, since it reads a header from the body.
+type decodingBody struct {
+	body      io.ReadCloser
+	newReader func(io.Reader) (io.ReadCloser, error)
+	decoder   io.ReadCloser
+	err       error
+}
+
+func (d *decodingBody) Read(p []byte) (int, error) {
+	if d.decoder == nil && d.err == nil {
+		d.decoder, d.err = d.newReader(d.body)
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+	return d.decoder.Read(p)
+}
+
+func (d *decodingBody) Close() error {
+	if d.decoder != nil {
+		d.decoder.Close()
+	}
+	return d.body.Close()
+}
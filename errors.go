@@ -0,0 +1,111 @@
+package chonker
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ProbeError is returned by Do when probing the server fails.
+type ProbeError struct {
+	// URL is the URL that was probed.
+	URL string
+	// StatusCode is the status code of the probe response.
+	// It is zero if there was no response.
+	StatusCode int
+	// Header is the header of the probe response, if any.
+	Header http.Header
+	// Err is the underlying error, if any.
+	Err error
+}
+
+func (e *ProbeError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("chonker: probing %s: unexpected status code %d", e.URL, e.StatusCode)
+	}
+	return fmt.Sprintf("chonker: probing %s: %v", e.URL, e.Err)
+}
+
+func (e *ProbeError) Unwrap() error {
+	return e.Err
+}
+
+// ChunkError is the error returned reading a response body when fetching a chunk fails.
+type ChunkError struct {
+	// Chunk is the chunk that failed.
+	Chunk Chunk
+	// URL is the URL the chunk was fetched from.
+	URL string
+	// Attempt is the number of times fetching the chunk was attempted.
+	Attempt int
+	// StatusCode is the status code of the chunk response.
+	// It is zero if there was no response.
+	StatusCode int
+	// Header is the header of the chunk response, if any.
+	Header http.Header
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *ChunkError) Error() string {
+	return fmt.Sprintf("chonker: fetching range %s of %s: %v", e.Chunk.RangeHeader(), e.URL, e.Err)
+}
+
+func (e *ChunkError) Unwrap() error {
+	return e.Err
+}
+
+// ChunkErrors is the error returned reading a response body when more than one chunk fails.
+// Once a chunk fails, no more chunks are requested, and the chunks already
+// requested are reported too if they fail, without being retried.
+type ChunkErrors []*ChunkError
+
+func (e ChunkErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("chonker: %d chunks failed: %s", len(e), strings.Join(msgs, "; "))
+}
+
+func (e ChunkErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
+// err returns nil if e is empty, the only error in e, or e itself.
+func (e ChunkErrors) err() error {
+	switch len(e) {
+	case 0:
+		return nil
+	case 1:
+		return e[0]
+	default:
+		return e
+	}
+}
+
+// RangeMismatchError is the error returned reading a response body when the
+// server sends a different range than the one requested for a chunk,
+// or a body whose length differs from that of the chunk.
+type RangeMismatchError struct {
+	// Requested is the chunk that was requested.
+	Requested Chunk
+	// Received is the range the server sent.
+	// If the body was too long, Received is only known to be at least as long as reported.
+	Received Chunk
+}
+
+// short reports whether the server sent the start of the requested range,
+// but the body ended early, like when a connection is cut.
+func (e *RangeMismatchError) short() bool {
+	return e.Received.Start == e.Requested.Start && e.Received.Length < e.Requested.Length
+}
+
+func (e *RangeMismatchError) Error() string {
+	return fmt.Sprintf("chonker: requested range %s, received %d bytes from %d",
+		e.Requested.RangeHeader(), e.Received.Length, e.Received.Start)
+}
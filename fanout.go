@@ -0,0 +1,199 @@
+package chonker
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Resolver looks up the addresses of a host, like net.Resolver.
+// An address may include a port, which then replaces the port of the URL.
+//
+// CDNs answer with several addresses, but connections tend to stick to one of
+// them. With a Resolver in Connections, chunks are spread over connections to
+// every address, keeping the URL, and so the Host header and TLS server name,
+// as they are. The throughput and errors of each address are tracked, and
+// addresses that fail, or are much slower than the fastest one, are demoted.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+const (
+	// minEdgeSamples is the number of chunks fetched from an edge before its
+	// throughput is compared to other edges.
+	minEdgeSamples = 2
+	// edgeDemotionRatio is the fraction of the throughput of the fastest
+	// edge below which an edge is demoted.
+	edgeDemotionRatio = 0.5
+	// demotedEdgeTurns is the number of turns of a demoted edge out of which
+	// it is still used once.
+	demotedEdgeTurns = 8
+)
+
+// edge is a server address that chunks are fetched from.
+type edge struct {
+	host string
+	addr string
+
+	mu       sync.Mutex
+	chunks   int
+	failures int
+	bytes    int64
+	elapsed  time.Duration
+}
+
+// record records a chunk response from e.
+func (e *edge) record(n int64, elapsed time.Duration, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err != nil {
+		e.failures++
+		return
+	}
+	e.chunks++
+	e.bytes += n
+	e.elapsed += elapsed
+}
+
+// stats returns the throughput of e in bytes per second, whether enough chunks
+// were fetched from e to know it, and whether e fails more than it succeeds.
+func (e *edge) stats() (float64, bool, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	failing := e.failures > 0 && e.failures >= e.chunks
+	if e.chunks < minEdgeSamples || e.elapsed <= 0 {
+		return 0, false, failing
+	}
+	return float64(e.bytes) / e.elapsed.Seconds(), true, failing
+}
+
+// demoted reports whether e fails, or is much slower than the fastest edge.
+func (p *connPool) demoted(e *edge) bool {
+	throughput, known, failing := e.stats()
+	if failing {
+		return true
+	}
+	if !known {
+		return false
+	}
+	var fastest float64
+	for _, other := range p.edges {
+		if t, ok, _ := other.stats(); ok && t > fastest {
+			fastest = t
+		}
+	}
+	return throughput < fastest*edgeDemotionRatio
+}
+
+// resolveEdges resolves the host of u with the resolver of r, if any.
+// It returns the edges to fan out to, or nil if there are fewer than two.
+func (r *Request) resolveEdges(u *url.URL) []*edge {
+	resolver := r.connections.Resolver
+	if resolver == nil {
+		return nil
+	}
+	addrs, err := resolver.LookupHost(r.Context(), u.Hostname())
+	if err != nil {
+		r.logger().Warn("chonker: error resolving host", "host", u.Hostname(), "error", err)
+		return nil
+	}
+	if len(addrs) < 2 {
+		return nil
+	}
+	edges := make([]*edge, len(addrs))
+	for i, addr := range addrs {
+		edges[i] = &edge{host: u.Host, addr: addr}
+	}
+	return edges
+}
+
+// pinTransport makes t connect to addr instead of host, which is a host and
+// port like the Host of a URL.
+func pinTransport(t *http.Transport, host, addr string) {
+	dial := t.DialContext
+	if dial == nil {
+		dial = defaultDialer.DialContext
+	}
+	t.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		wantHost, wantPort, err := net.SplitHostPort(address)
+		if err != nil || !hostMatches(host, wantHost) {
+			// Redirects or refreshed URLs might lead elsewhere.
+			return dial(ctx, network, address)
+		}
+		if _, _, err := net.SplitHostPort(addr); err == nil {
+			return dial(ctx, network, addr)
+		}
+		return dial(ctx, network, net.JoinHostPort(addr, wantPort))
+	}
+}
+
+// hostMatches reports whether the host of hostport is host.
+func hostMatches(hostport, host string) bool {
+	h, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		h = hostport
+	}
+	return h == host
+}
+
+// edgeTransport tracks the throughput and errors of responses from an edge.
+type edgeTransport struct {
+	http.RoundTripper
+	edge *edge
+}
+
+func (t *edgeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	m := getEdgeMetrics(t.edge.host, t.edge.addr)
+	start := time.Now()
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		t.edge.record(0, 0, err)
+		m.errorsTotal.Inc()
+		return nil, err
+	}
+	resp.Body = &edgeBody{ReadCloser: resp.Body, edge: t.edge, metrics: m, elapsed: time.Since(start)}
+	return resp, nil
+}
+
+// CloseIdleConnections closes the idle connections of the wrapped transport.
+func (t *edgeTransport) CloseIdleConnections() {
+	if c, ok := t.RoundTripper.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// edgeBody records the throughput of a response from an edge when it is closed.
+// Only the time spent waiting for the response and reading its body counts,
+// so that chunks waiting for their turn to be copied don't seem slow.
+type edgeBody struct {
+	io.ReadCloser
+	edge    *edge
+	metrics *edgeMetrics
+	elapsed time.Duration
+	n       int64
+	err     error
+}
+
+func (b *edgeBody) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := b.ReadCloser.Read(p)
+	b.elapsed += time.Since(start)
+	b.n += int64(n)
+	b.metrics.bytesTotal.Add(n)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+func (b *edgeBody) Close() error {
+	if b.err != nil {
+		b.metrics.errorsTotal.Inc()
+	}
+	b.edge.record(b.n, b.elapsed, b.err)
+	return b.ReadCloser.Close()
+}
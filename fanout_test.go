@@ -0,0 +1,86 @@
+package chonker
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeResolver resolves every host to addrs.
+type fakeResolver []string
+
+func (r fakeResolver) LookupHost(context.Context, string) ([]string, error) {
+	return r, nil
+}
+
+// hostRequests returns the number of requests s got for every Host header.
+func hostRequests(s *contentServer) map[string]int {
+	hosts := map[string]int{}
+	for _, r := range s.requested() {
+		hosts[r.Host]++
+	}
+	return hosts
+}
+
+func TestDo_Resolver(t *testing.T) {
+	content := makeData(3000)
+	fast := &contentServer{content: content}
+	fastServer := httptest.NewServer(fast)
+	defer fastServer.Close()
+	slow := &contentServer{content: content, hook: func(http.ResponseWriter, *http.Request) bool {
+		time.Sleep(30 * time.Millisecond)
+		return false
+	}}
+	slowServer := httptest.NewServer(slow)
+	defer slowServer.Close()
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	// The client itself reaches chonker.test at the fast server.
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if addr == "chonker.test:80" {
+				addr = fastServer.Listener.Addr().String()
+			}
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+
+	req, err := NewRequest(http.MethodGet, "http://chonker.test/file", nil, 100, 2)
+	assert.NoError(t, err)
+	req = req.WithRetry(3, 0).WithConnections(Connections{Resolver: fakeResolver{
+		fastServer.Listener.Addr().String(),
+		slowServer.Listener.Addr().String(),
+		deadAddr,
+	}})
+	resp, err := Do(client, req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	got, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, content, got)
+
+	fastHosts, slowHosts := hostRequests(fast), hostRequests(slow)
+	assert.Equal(t, []string{"chonker.test"}, keys(fastHosts))
+	assert.Equal(t, []string{"chonker.test"}, keys(slowHosts))
+	// The slow edge is demoted once its throughput is known.
+	assert.Less(t, slowHosts["chonker.test"], 10)
+	assert.Greater(t, fastHosts["chonker.test"], 20)
+	assert.Positive(t, getEdgeMetrics("chonker.test", deadAddr).errorsTotal.Get())
+}
+
+func keys(m map[string]int) []string {
+	var ks []string
+	for k := range m {
+		ks = append(ks, k)
+	}
+	return ks
+}
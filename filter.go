@@ -0,0 +1,66 @@
+package chonker
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// WithMinSize configures r to skip chunking content smaller than size bytes.
+// Such content is returned as it was received by the probe, if the probe
+// fetched all of it, and is otherwise fetched with a single plain request.
+func (r *Request) WithMinSize(size uint64) *Request {
+	r.minSize = size
+	return r
+}
+
+// WithContentTypes configures r to only fetch content in chunks if its media
+// type, as reported by the probe, is one of types.
+// A type ending with a slash, like "video/", matches every subtype.
+// Content of other types is fetched like content below WithMinSize.
+func (r *Request) WithContentTypes(types ...string) *Request {
+	r.contentTypes = types
+	return r
+}
+
+// shouldChunk reports whether content of size bytes, described by the probe
+// response header, should be fetched in chunks.
+func (r *Request) shouldChunk(header http.Header, size uint64) bool {
+	if size != UnknownSize && size < r.minSize {
+		return false
+	}
+	return len(r.contentTypes) == 0 || matchesContentType(header.Get("Content-Type"), r.contentTypes)
+}
+
+// matchesContentType reports whether the media type of contentType is one of types.
+func matchesContentType(contentType string, types []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range types {
+		t = strings.ToLower(t)
+		if mediaType == t || strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// doUnchunked sends r with c as it is, without fetching it in chunks.
+func (r *Request) doUnchunked(c *http.Client) (*http.Response, error) {
+	resp, err := r.wholeClient(c).Do(r.Request)
+	if err != nil {
+		return nil, err
+	}
+	if r.decodeContent {
+		if err := decodeBody(resp); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+	hostMetrics := getHostMetrics(r.URL.Host)
+	hostMetrics.requestsTotal.Inc()
+	hostMetrics.requestsTotalSansRange.Inc()
+	return resp, nil
+}
@@ -0,0 +1,133 @@
+package chonker
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDo_MinSizeAndContentTypes(t *testing.T) {
+	tests := []struct {
+		name        string
+		size        int
+		contentType string
+		rangeVal    string
+		configure   func(*Request) *Request
+		want        []string
+	}{
+		{
+			name:      "below min size",
+			size:      1000,
+			configure: func(r *Request) *Request { return r.WithMinSize(2000) },
+			want:      []string{"bytes=0-99", ""},
+		},
+		{
+			name:      "below min size in probe",
+			size:      80,
+			configure: func(r *Request) *Request { return r.WithMinSize(2000) },
+			want:      []string{"bytes=0-99"},
+		},
+		{
+			name:      "requested range below min size",
+			size:      1000,
+			rangeVal:  "bytes=100-299",
+			configure: func(r *Request) *Request { return r.WithMinSize(2000) },
+			want:      []string{"bytes=100-199", "bytes=100-299"},
+		},
+		{
+			name:      "above min size",
+			size:      300,
+			configure: func(r *Request) *Request { return r.WithMinSize(200) },
+			want:      []string{"bytes=0-99", "bytes=100-199", "bytes=200-299"},
+		},
+		{
+			name:        "matching content type",
+			size:        200,
+			contentType: "video/mp4",
+			configure:   func(r *Request) *Request { return r.WithContentTypes("application/zip", "video/") },
+			want:        []string{"bytes=0-99", "bytes=100-199"},
+		},
+		{
+			name:        "other content type",
+			size:        200,
+			contentType: "application/json; charset=utf-8",
+			configure:   func(r *Request) *Request { return r.WithContentTypes("video/") },
+			want:        []string{"bytes=0-99", ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := makeData(tt.size)
+			handler := &contentServer{content: content, hook: func(w http.ResponseWriter, _ *http.Request) bool {
+				w.Header().Set("Content-Type", tt.contentType)
+				return false
+			}}
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			req, err := NewRequest(http.MethodGet, server.URL, nil, 100, 1)
+			assert.NoError(t, err)
+			if tt.rangeVal != "" {
+				req.Header.Set("Range", tt.rangeVal)
+			}
+			resp, err := Do(nil, tt.configure(req))
+			assert.NoError(t, err)
+			defer resp.Body.Close()
+
+			got, err := io.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			if tt.rangeVal != "" {
+				assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+				assert.Equal(t, content[100:300], got)
+			} else {
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				assert.Equal(t, content, got)
+			}
+			assert.Equal(t, tt.want, handler.ranges())
+		})
+	}
+}
+
+func TestNewRoundTripperWithOptions_Filters(t *testing.T) {
+	handler := &contentServer{content: makeData(200)}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	c, err := NewClientWithOptions(nil,
+		WithChunkSize(100),
+		WithMethods(http.MethodGet),
+		WithURLPattern(regexp.MustCompile(`/downloads/`)),
+	)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		method, path string
+		chunked      bool
+	}{
+		{http.MethodGet, "/downloads/file", true},
+		{http.MethodGet, "/api/status", false},
+		{http.MethodPost, "/downloads/file", false},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, server.URL+tt.path, nil)
+		assert.NoError(t, err)
+		before := len(handler.ranges())
+		resp, err := c.Do(req)
+		assert.NoError(t, err)
+		_, err = io.Copy(io.Discard, resp.Body)
+		assert.NoError(t, err)
+		resp.Body.Close()
+
+		got := handler.ranges()[before:]
+		if tt.chunked {
+			assert.Equal(t, []string{"bytes=0-99", "bytes=100-199"}, got, tt.method+" "+tt.path)
+		} else {
+			assert.Equal(t, []string{""}, got, tt.method+" "+tt.path)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package chonker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"time"
+)
+
+// ErrTruncated is returned reading a followed response body when the remote
+// content shrinks, or is replaced, after it has been read.
+var ErrTruncated = errors.New("chonker: followed content was truncated or replaced")
+
+// Follow returns a reader that reads the content of r and then keeps reading
+// the content appended to it, like tail -f over HTTP.
+//
+// Each time the reader reaches the current end of the content, it polls the
+// server every interval with a ranged request starting at the last offset read.
+// New content is fetched in chunks as in Do.
+// The size of the content reported by the server is used to detect growth,
+// and changes to its ETag to detect truncation or replacement,
+// upon which reads fail with ErrTruncated.
+//
+// If r has a Range header, it must be an open range like "bytes=100-".
+// Following stops when the reader is closed or the context of r is done.
+func Follow(c *http.Client, r *Request, interval time.Duration) (io.ReadCloser, error) {
+	if r == nil || r.Request == nil {
+		return nil, errors.New("chonker: request cannot be nil")
+	}
+	if !r.isValid() || interval <= 0 {
+		return nil, ErrInvalidArgument
+	}
+
+	var offset uint64
+	if rangeVal := r.Header.Get(headerNameRange); rangeVal != "" {
+		cs, err := ParseRange(rangeVal, math.MaxInt64)
+		if err != nil || len(cs) != 1 || isSuffixRange(rangeVal) || cs[0].Start+cs[0].Length != math.MaxInt64 {
+			return nil, fmt.Errorf("chonker: can't follow range %s: %w", rangeVal, ErrInvalidRange)
+		}
+		offset = cs[0].Start
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	read, write := io.Pipe()
+	f := &follower{
+		PipeReader: read,
+		client:     c,
+		request:    r,
+		interval:   interval,
+		offset:     offset,
+		cancel:     cancel,
+	}
+	go func() {
+		write.CloseWithError(f.follow(ctx, write))
+	}()
+
+	return f, nil
+}
+
+type follower struct {
+	*io.PipeReader
+
+	client   *http.Client
+	request  *Request
+	interval time.Duration
+	cancel   context.CancelFunc
+
+	// offset is the offset of the next byte to read.
+	offset uint64
+	// read is true once any content has been read,
+	// and last is the last byte read.
+	read bool
+	last byte
+	// etag is the last ETag seen for the content.
+	etag string
+}
+
+// Close stops following the content.
+func (f *follower) Close() error {
+	f.cancel()
+	return f.PipeReader.Close()
+}
+
+// follow polls the server for new content and writes it to w,
+// until ctx is done or an error occurs.
+func (f *follower) follow(ctx context.Context, w io.Writer) error {
+	for {
+		grew, err := f.poll(ctx, w)
+		if err != nil {
+			return err
+		}
+		if grew {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(f.interval):
+		}
+	}
+}
+
+// poll fetches the content past the current offset, if any, and writes it to w.
+// It returns true if there was new content.
+//
+// Unless nothing has been read yet, the request overlaps the content already
+// read by a byte. That way every poll gets a partial response, with the current
+// size and ETag of the content, and the byte is checked against the last one read.
+func (f *follower) poll(ctx context.Context, w io.Writer) (bool, error) {
+	start := f.offset
+	if f.read {
+		start--
+	}
+	req := *f.request
+	req.Request = f.request.Clone(ctx)
+	req.Header.Set(headerNameRange, fmt.Sprintf("bytes=%d-", start))
+	// Every poll asks the server for the current size of the content,
+	// which a cached or known size would hide.
+	req.probeCache = nil
+	req.sizeKnown, req.size, req.validator = false, 0, ""
+
+	resp, err := Do(f.client, &req)
+	if err == nil {
+		defer resp.Body.Close()
+	}
+	if endsBefore(resp, err) {
+		if f.read {
+			// Even the last byte read is gone.
+			return false, ErrTruncated
+		}
+		// There is no content yet.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return false, fmt.Errorf("%w, got status %s", ErrRangeUnsupported, resp.Status)
+	}
+	if err := f.check(resp.Header); err != nil {
+		return false, err
+	}
+
+	body := resp.Body
+	if f.read {
+		var b [1]byte
+		if _, err := io.ReadFull(body, b[:]); err != nil {
+			return false, err
+		}
+		if b[0] != f.last {
+			return false, ErrTruncated
+		}
+	}
+
+	lw := &lastByteWriter{Writer: w}
+	n, err := io.Copy(lw, body)
+	f.offset += uint64(n)
+	if n > 0 {
+		f.read = true
+		f.last = lw.last
+	}
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// endsBefore reports whether resp and err, the result of a poll, show that
+// the content ends before the start of the polled range:
+// the range isn't satisfiable, or the content is empty, which some servers
+// answer range requests for with an empty 200 response.
+func endsBefore(resp *http.Response, err error) bool {
+	var probeErr *ProbeError
+	switch {
+	case errors.As(err, &probeErr):
+		return probeErr.StatusCode == http.StatusRequestedRangeNotSatisfiable ||
+			probeErr.StatusCode == http.StatusOK && probeErr.Header.Get(headerNameContentLength) == "0"
+	case err != nil:
+		return errors.Is(err, ErrRangeNoOverlap)
+	default:
+		return resp.StatusCode == http.StatusOK && resp.ContentLength == 0
+	}
+}
+
+// check returns ErrTruncated if the headers of a response show that the content
+// has shrunk below the current offset, or has been replaced.
+func (f *follower) check(h http.Header) error {
+	etag := h.Get(headerNameETag)
+	defer func() {
+		if etag != "" {
+			f.etag = etag
+		}
+	}()
+
+	_, size, err := ParseContentRange(h.Get(headerNameContentRange))
+	if err != nil {
+		// Without a size, there's nothing to check.
+		return nil
+	}
+	if size != UnknownSize && size < f.offset {
+		return ErrTruncated
+	}
+	// The ETag of growing content changes as it grows.
+	// If it changes while the size stays the same, the content was replaced.
+	if size == f.offset && f.etag != "" && etag != "" && etag != f.etag {
+		return ErrTruncated
+	}
+	return nil
+}
+
+// lastByteWriter is an io.Writer that remembers the last byte written through it.
+type lastByteWriter struct {
+	io.Writer
+	last byte
+}
+
+func (w *lastByteWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if n > 0 {
+		w.last = p[n-1]
+	}
+	return n, err
+}
@@ -0,0 +1,175 @@
+package chonker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFollow(t *testing.T) {
+	content := makeData(1024)
+
+	var mu sync.Mutex
+	size, version := 100, 1
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			w.Header().Set("ETag", fmt.Sprintf(`"%d"`, version))
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content[:size]))
+		}),
+	)
+	defer server.Close()
+
+	update := func(newSize, newVersion int) {
+		mu.Lock()
+		defer mu.Unlock()
+		size, version = newSize, newVersion
+	}
+
+	req, err := NewRequest(http.MethodGet, server.URL, nil, 64, 4)
+	assert.NoError(t, err)
+	req.Header.Set("Range", "bytes=10-")
+
+	body, err := Follow(nil, req, 10*time.Millisecond)
+	assert.NoError(t, err)
+	defer body.Close()
+
+	buf := make([]byte, 90)
+	_, err = io.ReadFull(body, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, content[10:100], buf)
+
+	// The content grows.
+	update(500, 2)
+	buf = make([]byte, 400)
+	_, err = io.ReadFull(body, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, content[100:500], buf)
+
+	// The content is replaced with content of the same size.
+	update(500, 3)
+	_, err = body.Read(buf)
+	assert.ErrorIs(t, err, ErrTruncated)
+}
+
+func TestFollow_Truncated(t *testing.T) {
+	content := makeData(1024)
+
+	var mu sync.Mutex
+	size := 100
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content[:size]))
+		}),
+	)
+	defer server.Close()
+
+	req, err := NewRequest(http.MethodGet, server.URL, nil, 64, 4)
+	assert.NoError(t, err)
+
+	body, err := Follow(nil, req, 10*time.Millisecond)
+	assert.NoError(t, err)
+	defer body.Close()
+
+	buf := make([]byte, 100)
+	_, err = io.ReadFull(body, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, content[:100], buf)
+
+	mu.Lock()
+	size = 50
+	mu.Unlock()
+
+	_, err = body.Read(buf)
+	assert.ErrorIs(t, err, ErrTruncated)
+}
+
+func TestFollow_Grows(t *testing.T) {
+	content := makeData(1024)
+
+	tests := []struct {
+		name  string
+		size  int
+		setup func(*Request) *Request
+	}{
+		{
+			name:  "probe cache",
+			size:  100,
+			setup: func(r *Request) *Request { return r.WithProbeCache(NewProbeCache(time.Minute)) },
+		},
+		{
+			name: "probe head",
+			size: 100,
+			setup: func(r *Request) *Request {
+				return r.WithProbeCache(NewProbeCache(time.Minute)).WithProbeStrategy(ProbeHead)
+			},
+		},
+		{
+			name:  "empty",
+			setup: func(r *Request) *Request { return r },
+		},
+		{
+			name:  "empty opportunistic",
+			setup: func(r *Request) *Request { return r.WithOpportunisticRange() },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			size := tt.size
+			server := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					mu.Lock()
+					defer mu.Unlock()
+					http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content[:size]))
+				}),
+			)
+			defer server.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			req, err := NewRequestWithContext(ctx, http.MethodGet, server.URL, nil, 64, 4)
+			assert.NoError(t, err)
+
+			body, err := Follow(nil, tt.setup(req), 10*time.Millisecond)
+			assert.NoError(t, err)
+			defer body.Close()
+
+			buf := make([]byte, tt.size)
+			_, err = io.ReadFull(body, buf)
+			assert.NoError(t, err)
+			assert.Equal(t, content[:tt.size], buf)
+
+			// Let a poll find nothing new before the content grows.
+			time.Sleep(30 * time.Millisecond)
+			mu.Lock()
+			size = 500
+			mu.Unlock()
+			buf = make([]byte, 500-tt.size)
+			_, err = io.ReadFull(body, buf)
+			assert.NoError(t, err)
+			assert.Equal(t, content[tt.size:500], buf)
+		})
+	}
+}
+
+func TestFollow_InvalidRange(t *testing.T) {
+	req, err := NewRequest(http.MethodGet, "http://example.com", nil, 64, 4)
+	assert.NoError(t, err)
+	req.Header.Set("Range", "bytes=10-20")
+
+	_, err = Follow(nil, req, time.Second)
+	assert.Error(t, err)
+}
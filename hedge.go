@@ -0,0 +1,193 @@
+package chonker
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// Hedging configures hedged chunk requests.
+// If a chunk takes longer to respond than a percentile of the response times
+// of the chunks fetched from the same host so far, it is requested again,
+// and whichever response arrives first is used. The other request is cancelled.
+// Hedging cuts the tail latency of downloads, where a single slow chunk
+// holds up all the chunks after it.
+type Hedging struct {
+	// Percentile of chunk response times after which a chunk is hedged, like 0.95.
+	Percentile float64
+	// Budget is the largest fraction of chunk requests to a host that are
+	// hedged, like 0.05.
+	Budget float64
+	// MinSamples is the number of chunks that must have been fetched from a
+	// host before its chunks are hedged. It defaults to 20.
+	MinSamples uint64
+	// Client sends hedged requests, to use other connections than the ones
+	// that are slow. If nil, the client of the request is used.
+	Client *http.Client
+	// Mirror is the URL of a mirror of the content that hedged requests are
+	// sent to, if not nil. The mirror must serve the same content with the
+	// same ETag.
+	Mirror *url.URL
+}
+
+const defaultHedgingMinSamples = 20
+
+// delay returns the duration after which chunks are hedged,
+// given the response times of the chunks fetched so far.
+// The second return value is false if there are not enough samples, or the
+// percentile falls in the unbounded bucket of the histogram.
+func (h *Hedging) delay(durations *metrics.Histogram) (time.Duration, bool) {
+	minSamples := h.MinSamples
+	if minSamples == 0 {
+		minSamples = defaultHedgingMinSamples
+	}
+	var total uint64
+	durations.VisitNonZeroBuckets(func(_ string, count uint64) {
+		total += count
+	})
+	if total < minSamples {
+		return 0, false
+	}
+
+	// Buckets are visited in increasing order.
+	var seen uint64
+	var upper float64
+	found := false
+	durations.VisitNonZeroBuckets(func(vmrange string, count uint64) {
+		if found {
+			return
+		}
+		seen += count
+		if float64(seen) >= h.Percentile*float64(total) {
+			found = true
+			_, end, _ := strings.Cut(vmrange, "...")
+			var err error
+			if upper, err = strconv.ParseFloat(end, 64); err != nil {
+				found = false
+			}
+		}
+	})
+	if !found || upper <= 0 || upper > float64(1<<62)/float64(time.Second) {
+		return 0, false
+	}
+	return time.Duration(upper * float64(time.Second)), true
+}
+
+// reserve counts another hedged chunk, and reports whether it is within the
+// budget. Chunks are counted before the budget is checked, and uncounted if
+// they are over it, so that concurrent chunks can't all pass the check.
+func (h *Hedging) reserve(m *hostMetrics) bool {
+	m.requestChunksHedgedTotal.Inc()
+	if float64(m.requestChunksHedgedTotal.Get()) <= h.Budget*float64(m.requestChunksTotal.Get()+1) {
+		return true
+	}
+	m.requestChunksHedgedTotal.Dec()
+	return false
+}
+
+// backup returns the client and request for a hedged request for req.
+// Requests to a mirror on another host lose their credentials, like requests
+// redirected there would.
+func (h *Hedging) backup(c *http.Client, req *http.Request) hedgeAttempt {
+	if h.Client != nil {
+		c = h.Client
+	}
+	if h.Mirror != nil {
+		req = req.Clone(req.Context())
+		redirectRequest(req, h.Mirror)
+	}
+	return hedgeAttempt{client: c, req: req}
+}
+
+// hedgeAttempt is a request and the client to send it with.
+type hedgeAttempt struct {
+	client *http.Client
+	req    *http.Request
+}
+
+type hedgeResult struct {
+	attempt int
+	resp    *http.Response
+	err     error
+}
+
+// hedgedDo sends the primary request. If no response arrives within delay
+// and hedge reports true, the backup request is sent, and the first response
+// to arrive wins. The other request is cancelled.
+// If hedge reports false, it is asked again after another delay.
+// The second return value is true if the backup request was sent.
+func hedgedDo(primary, backup hedgeAttempt, delay time.Duration, hedge func() bool) (*http.Response, bool, error) {
+	results := make(chan hedgeResult, 2)
+	var cancels []context.CancelFunc
+	send := func(a hedgeAttempt) {
+		ctx, cancel := context.WithCancel(a.req.Context())
+		attempt := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			resp, err := a.client.Do(a.req.Clone(ctx)) //nolint:bodyclose
+			results <- hedgeResult{attempt, resp, err}
+		}()
+	}
+	send(primary)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	pending := 1
+	for {
+		select {
+		case <-timer.C:
+			if len(cancels) == 1 && hedge() {
+				send(backup)
+				pending++
+			} else if len(cancels) == 1 {
+				timer.Reset(delay)
+			}
+		case res := <-results:
+			pending--
+			hedged := len(cancels) > 1
+			if res.err != nil && pending > 0 {
+				// Wait for the other request.
+				cancels[res.attempt]()
+				continue
+			}
+			for i, cancel := range cancels {
+				if i != res.attempt {
+					cancel()
+				}
+			}
+			if pending > 0 {
+				go func() {
+					if loser := <-results; loser.resp != nil {
+						loser.resp.Body.Close()
+					}
+				}()
+			}
+			if res.err != nil {
+				cancels[res.attempt]()
+				return nil, hedged, res.err
+			}
+			res.resp.Body = &cancelOnCloseBody{ReadCloser: res.resp.Body, cancel: cancels[res.attempt]}
+			return res.resp, hedged, nil
+		}
+	}
+}
+
+// cancelOnCloseBody cancels the context of the request it is the response
+// body of when it is closed.
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnCloseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,123 @@
+package chonker
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHedging_Delay(t *testing.T) {
+	durations := metrics.NewSet().NewHistogram("durations")
+	for i := 0; i < 90; i++ {
+		durations.Update(0.01)
+	}
+	for i := 0; i < 10; i++ {
+		durations.Update(1)
+	}
+
+	delay, ok := (&Hedging{Percentile: 0.5}).delay(durations)
+	assert.True(t, ok)
+	assert.GreaterOrEqual(t, delay, 10*time.Millisecond)
+	assert.Less(t, delay, 12*time.Millisecond)
+
+	delay, ok = (&Hedging{Percentile: 0.95}).delay(durations)
+	assert.True(t, ok)
+	assert.GreaterOrEqual(t, delay, time.Second)
+	assert.Less(t, delay, 1200*time.Millisecond)
+
+	_, ok = (&Hedging{Percentile: 0.5, MinSamples: 200}).delay(durations)
+	assert.False(t, ok)
+}
+
+func TestHedging_Reserve(t *testing.T) {
+	m := getHostMetrics(t.Name())
+	m.requestChunksTotal.Set(99)
+	m.requestChunksHedgedTotal.Set(0)
+	h := &Hedging{Budget: 0.1}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	reserved := 0
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if h.reserve(m) {
+				mu.Lock()
+				reserved++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, reserved, 10)
+	assert.Positive(t, reserved)
+	assert.Equal(t, uint64(reserved), m.requestChunksHedgedTotal.Get())
+}
+
+func TestDo_Hedging(t *testing.T) {
+	content := makeData(300)
+
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Range") == "bytes=250-259" {
+				// Stall this chunk until it's cancelled.
+				<-r.Context().Done()
+				return
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+		}),
+	)
+	defer server.Close()
+
+	mirror := &contentServer{content: content}
+	mirrorServer := httptest.NewServer(mirror)
+	defer mirrorServer.Close()
+	// The mirror is on another host, which the hedging client reaches at the
+	// mirror server.
+	mirrorURL, err := url.Parse("http://mirror.test/file")
+	assert.NoError(t, err)
+	mirrorClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, mirrorServer.Listener.Addr().String())
+		},
+	}}
+
+	req, err := NewRequest(http.MethodGet, server.URL, nil, 10, 2)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Cookie", "session=secret")
+	req.Header.Set("Proxy-Authorization", "Basic secret")
+	resp, err := Do(nil, req.WithHedging(Hedging{
+		Percentile: 0.9,
+		Budget:     0.5,
+		MinSamples: 5,
+		Client:     mirrorClient,
+		Mirror:     mirrorURL,
+	}))
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	got, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, content, got)
+
+	assert.Contains(t, mirror.ranges(), "bytes=250-259")
+	// The mirror never sees the credentials meant for the requested host.
+	for _, r := range mirror.requested() {
+		assert.Equal(t, "mirror.test", r.Host)
+		assert.Empty(t, r.Header.Get("Authorization"))
+		assert.Empty(t, r.Header.Get("Cookie"))
+		assert.Empty(t, r.Header.Get("Proxy-Authorization"))
+	}
+}
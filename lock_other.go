@@ -0,0 +1,16 @@
+//go:build !unix && !windows
+
+package chonker
+
+import "os"
+
+// lockFile does nothing on systems without file locks. Processes sharing a
+// ChunkCache there rely on atomic renames alone.
+func lockFile(*os.File, bool) error {
+	return nil
+}
+
+// unlockFile does nothing on systems without file locks.
+func unlockFile(*os.File) error {
+	return nil
+}
@@ -18,9 +18,27 @@ import (
 // chonker_http_request_chunks_fetching{host="example.com",stage="do"}
 // chonker_http_request_chunks_fetching{host="example.com",stage="copy"}
 // chonker_http_request_chunks_total{host="example.com"}
+// chonker_http_request_chunks_range_ignored_total{host="example.com"}
+// chonker_http_request_chunks_hedged_total{host="example.com"}
+// chonker_http_request_chunks_stalled_total{host="example.com"}
+// chonker_http_request_redirects_saved_total{host="example.com"}
+// chonker_http_request_chunks_cached_total{host="example.com"}
 // chonker_http_request_chunk_duration_seconds{host="example.com"}
+// chonker_http_request_chunk_response_seconds{host="example.com"}
 // chonker_http_request_chunk_bytes{host="example.com"}
 //
+// Chunks fetched from local addresses configured with Connections.LocalAddrs
+// are also counted by source address, like 192.0.2.1:
+//
+// chonker_http_source_bytes_total{host="example.com",source="192.0.2.1"}
+// chonker_http_source_read_seconds_total{host="example.com",source="192.0.2.1"}
+//
+// Chunks fetched from the server addresses found by Connections.Resolver are
+// also counted by server address, like 198.51.100.1:
+//
+// chonker_http_edge_bytes_total{host="example.com",edge="198.51.100.1"}
+// chonker_http_edge_errors_total{host="example.com",edge="198.51.100.1"}
+//
 // You can surface these metrics in your application using the
 // [metrics.RegisterSet] function.
 //
@@ -40,8 +58,27 @@ type hostMetrics struct {
 	requestChunksFetchingStageCopy *metrics.Gauge
 	// requestChunksTotal is the total number of request chunks completed to a host.
 	requestChunksTotal *metrics.Counter
+	// requestChunksRangeIgnoredTotal is the total number of request chunks to a host
+	// that were answered with the whole content instead of the requested range.
+	requestChunksRangeIgnoredTotal *metrics.Counter
+	// requestChunksHedgedTotal is the total number of request chunks to a host
+	// that were requested again because the first request was slow.
+	requestChunksHedgedTotal *metrics.Counter
+	// requestChunksStalledTotal is the total number of request chunks to a host
+	// that stalled and were cancelled.
+	requestChunksStalledTotal *metrics.Counter
+	// requestRedirectsSavedTotal is the total number of redirects that request
+	// chunks to a host skipped by going straight to the URL redirected to.
+	requestRedirectsSavedTotal *metrics.Counter
+	// requestChunksCachedTotal is the total number of request chunks to a host
+	// that were served from a ChunkCache.
+	requestChunksCachedTotal *metrics.Counter
 	// requestChunkDurationSeconds measures the duration of request chunks to a host.
 	requestChunkDurationSeconds *metrics.Histogram
+	// requestChunkResponseSeconds measures the time request chunks to a host
+	// take to respond, without the time spent reading and writing their bodies,
+	// which waits for the chunks before them. Hedging delays are based on it.
+	requestChunkResponseSeconds *metrics.Histogram
 	// requestChunkBytes measures the number of bytes fetched in request chunks to a host.
 	requestChunkBytes *metrics.Histogram
 }
@@ -66,11 +103,69 @@ func getHostMetrics(host string) *hostMetrics {
 		requestChunksTotal: StatsForNerds.GetOrCreateCounter(
 			fmt.Sprintf(`chonker_http_request_chunks_total{host="%s"}`, host),
 		),
+		requestChunksRangeIgnoredTotal: StatsForNerds.GetOrCreateCounter(
+			fmt.Sprintf(`chonker_http_request_chunks_range_ignored_total{host="%s"}`, host),
+		),
+		requestChunksHedgedTotal: StatsForNerds.GetOrCreateCounter(
+			fmt.Sprintf(`chonker_http_request_chunks_hedged_total{host="%s"}`, host),
+		),
+		requestChunksStalledTotal: StatsForNerds.GetOrCreateCounter(
+			fmt.Sprintf(`chonker_http_request_chunks_stalled_total{host="%s"}`, host),
+		),
+		requestRedirectsSavedTotal: StatsForNerds.GetOrCreateCounter(
+			fmt.Sprintf(`chonker_http_request_redirects_saved_total{host="%s"}`, host),
+		),
+		requestChunksCachedTotal: StatsForNerds.GetOrCreateCounter(
+			fmt.Sprintf(`chonker_http_request_chunks_cached_total{host="%s"}`, host),
+		),
 		requestChunkDurationSeconds: StatsForNerds.GetOrCreateHistogram(
 			fmt.Sprintf(`chonker_http_request_chunk_duration_seconds{host="%s"}`, host),
 		),
+		requestChunkResponseSeconds: StatsForNerds.GetOrCreateHistogram(
+			fmt.Sprintf(`chonker_http_request_chunk_response_seconds{host="%s"}`, host),
+		),
 		requestChunkBytes: StatsForNerds.GetOrCreateHistogram(
 			fmt.Sprintf(`chonker_http_request_chunk_bytes{host="%s"}`, host),
 		),
 	}
 }
+
+type sourceMetrics struct {
+	// bytesTotal is the total number of bytes of response bodies read from a
+	// host over connections from a source address.
+	bytesTotal *metrics.Counter
+	// readSecondsTotal is the total time spent reading those bytes.
+	// The throughput from a source is the ratio of the rates of the two.
+	readSecondsTotal *metrics.FloatCounter
+}
+
+func getSourceMetrics(host, source string) *sourceMetrics {
+	return &sourceMetrics{
+		bytesTotal: StatsForNerds.GetOrCreateCounter(
+			fmt.Sprintf(`chonker_http_source_bytes_total{host="%s",source="%s"}`, host, source),
+		),
+		readSecondsTotal: StatsForNerds.GetOrCreateFloatCounter(
+			fmt.Sprintf(`chonker_http_source_read_seconds_total{host="%s",source="%s"}`, host, source),
+		),
+	}
+}
+
+type edgeMetrics struct {
+	// bytesTotal is the total number of bytes of response bodies read from
+	// a host over connections to one of its addresses.
+	bytesTotal *metrics.Counter
+	// errorsTotal is the total number of requests to a host over connections
+	// to one of its addresses that failed.
+	errorsTotal *metrics.Counter
+}
+
+func getEdgeMetrics(host, edge string) *edgeMetrics {
+	return &edgeMetrics{
+		bytesTotal: StatsForNerds.GetOrCreateCounter(
+			fmt.Sprintf(`chonker_http_edge_bytes_total{host="%s",edge="%s"}`, host, edge),
+		),
+		errorsTotal: StatsForNerds.GetOrCreateCounter(
+			fmt.Sprintf(`chonker_http_edge_errors_total{host="%s",edge="%s"}`, host, edge),
+		),
+	}
+}
@@ -0,0 +1,118 @@
+package objstore
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ErrChecksumMismatch is returned reading an object whose content does not
+// match the checksum stored with it.
+var ErrChecksumMismatch = errors.New("objstore: checksum mismatch")
+
+// Checksum is a checksum of the whole content of an object.
+type Checksum struct {
+	// Algorithm is one of CRC32, CRC32C, SHA1, SHA256, or MD5.
+	Algorithm string
+	// Value is the base64 encoded checksum.
+	Value string
+}
+
+// checksumHeaders are the S3 checksum headers, in order of preference.
+var checksumHeaders = []struct {
+	name      string
+	algorithm string
+}{
+	{"X-Amz-Checksum-Sha256", "SHA256"},
+	{"X-Amz-Checksum-Sha1", "SHA1"},
+	{"X-Amz-Checksum-Crc32c", "CRC32C"},
+	{"X-Amz-Checksum-Crc32", "CRC32"},
+}
+
+// checksumFromHeader returns the checksum of the whole object in header,
+// or nil if there is none.
+// Composite checksums of multipart uploads are checksums of the checksums of
+// their parts, which can't be verified from the content alone, so they are ignored.
+func checksumFromHeader(header http.Header) *Checksum {
+	if header.Get("X-Amz-Checksum-Type") != "COMPOSITE" {
+		for _, h := range checksumHeaders {
+			if v := header.Get(h.name); v != "" && !strings.Contains(v, "-") {
+				return &Checksum{Algorithm: h.algorithm, Value: v}
+			}
+		}
+	}
+
+	// GCS reports the CRC32C and MD5 hashes of objects in one header:
+	// x-goog-hash: crc32c=n03x6A==,md5=Ojk9c3dhfxgoKVVHYwFbHQ==
+	var md5Sum string
+	for _, v := range header.Values("X-Goog-Hash") {
+		for _, kv := range strings.Split(v, ",") {
+			k, v, _ := strings.Cut(strings.TrimSpace(kv), "=")
+			switch k {
+			case "crc32c":
+				return &Checksum{Algorithm: "CRC32C", Value: v}
+			case "md5":
+				md5Sum = v
+			}
+		}
+	}
+	if md5Sum != "" {
+		return &Checksum{Algorithm: "MD5", Value: md5Sum}
+	}
+	return nil
+}
+
+func (c *Checksum) newHash() (hash.Hash, error) {
+	switch c.Algorithm {
+	case "CRC32":
+		return crc32.NewIEEE(), nil
+	case "CRC32C":
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli)), nil
+	case "SHA1":
+		return sha1.New(), nil
+	case "SHA256":
+		return sha256.New(), nil
+	case "MD5":
+		return md5.New(), nil
+	default:
+		return nil, fmt.Errorf("objstore: unsupported checksum algorithm %s", c.Algorithm)
+	}
+}
+
+// verifyingBody hashes the content read from it and checks the hash
+// against a checksum once the content ends.
+type verifyingBody struct {
+	io.ReadCloser
+	checksum *Checksum
+	hash     hash.Hash
+}
+
+func newVerifyingBody(body io.ReadCloser, checksum *Checksum) (io.ReadCloser, error) {
+	h, err := checksum.newHash()
+	if err != nil {
+		return nil, err
+	}
+	return &verifyingBody{ReadCloser: body, checksum: checksum, hash: h}, nil
+}
+
+func (b *verifyingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+	if err == io.EOF {
+		want, decodeErr := base64.StdEncoding.DecodeString(b.checksum.Value)
+		if got := b.hash.Sum(nil); decodeErr != nil || !bytes.Equal(got, want) {
+			return n, fmt.Errorf("%w: %s is %s, expected %s", ErrChecksumMismatch,
+				b.checksum.Algorithm, base64.StdEncoding.EncodeToString(got), b.checksum.Value)
+		}
+	}
+	return n, err
+}
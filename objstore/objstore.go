@@ -0,0 +1,352 @@
+// Package objstore fetches objects from Amazon S3 and Google Cloud Storage
+// with chonker.
+//
+// Objects are named by s3://bucket/key and gs://bucket/key URIs.
+// Requests are signed with AWS Signature Version 4, which GCS accepts when
+// made with HMAC keys.
+// The size and ETag of an object are read with a HEAD request, so chunks are
+// fetched without probing. Objects uploaded in parts of the same size are
+// fetched in chunks aligned to their parts, and objects with a full-object
+// checksum are verified as they are read.
+package objstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ananthb/chonker"
+)
+
+const (
+	SchemeS3  = "s3"
+	SchemeGCS = "gs"
+
+	defaultS3Region    = "us-east-1"
+	defaultGCSEndpoint = "https://storage.googleapis.com"
+
+	headerNameAmzChecksumMode = "X-Amz-Checksum-Mode"
+	headerNameAmzPartsCount   = "X-Amz-Mp-Parts-Count"
+)
+
+var ErrInvalidURI = errors.New("objstore: invalid object URI")
+
+// ParseURI splits an s3://bucket/key or gs://bucket/key URI into its scheme,
+// bucket, and key.
+func ParseURI(uri string) (scheme, bucket, key string, err error) {
+	scheme, rest, ok := strings.Cut(uri, "://")
+	if !ok || scheme != SchemeS3 && scheme != SchemeGCS {
+		return "", "", "", fmt.Errorf("%w: %s", ErrInvalidURI, uri)
+	}
+	bucket, key, _ = strings.Cut(rest, "/")
+	if bucket == "" || key == "" {
+		return "", "", "", fmt.Errorf("%w: %s", ErrInvalidURI, uri)
+	}
+	return scheme, bucket, key, nil
+}
+
+// IsURI reports whether uri is an s3:// or gs:// URI.
+func IsURI(uri string) bool {
+	return strings.HasPrefix(uri, SchemeS3+"://") || strings.HasPrefix(uri, SchemeGCS+"://")
+}
+
+// Config configures how a Client reaches a storage service.
+type Config struct {
+	// Credentials sign requests. If the access key ID is empty,
+	// requests are not signed, which works for public objects.
+	Credentials Credentials
+	// Region is the region requests are signed for.
+	// It defaults to us-east-1 for S3, and is always auto for GCS.
+	Region string
+	// Endpoint is the URL of an S3 compatible service, like MinIO.
+	// Objects are then addressed with path-style URLs.
+	// If empty, the service of the scheme is used.
+	Endpoint string
+}
+
+// ConfigFromEnv returns the configuration of the service of scheme
+// from environment variables.
+//
+// For S3, AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN,
+// AWS_REGION (or AWS_DEFAULT_REGION), and AWS_ENDPOINT_URL are used.
+// For GCS, the HMAC key in GCS_HMAC_ACCESS_KEY_ID and GCS_HMAC_SECRET
+// and the endpoint in GCS_ENDPOINT_URL are used.
+func ConfigFromEnv(scheme string) (Config, error) {
+	switch scheme {
+	case SchemeS3:
+		region := os.Getenv("AWS_REGION")
+		if region == "" {
+			region = os.Getenv("AWS_DEFAULT_REGION")
+		}
+		return Config{
+			Credentials: Credentials{
+				AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+				SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+				SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+			},
+			Region:   region,
+			Endpoint: os.Getenv("AWS_ENDPOINT_URL"),
+		}, nil
+	case SchemeGCS:
+		return Config{
+			Credentials: Credentials{
+				AccessKeyID:     os.Getenv("GCS_HMAC_ACCESS_KEY_ID"),
+				SecretAccessKey: os.Getenv("GCS_HMAC_SECRET"),
+			},
+			Endpoint: os.Getenv("GCS_ENDPOINT_URL"),
+		}, nil
+	default:
+		return Config{}, fmt.Errorf("objstore: unsupported scheme %s", scheme)
+	}
+}
+
+// Client fetches objects from the storage service of one scheme.
+type Client struct {
+	scheme   string
+	config   Config
+	signer   *Signer
+	client   *http.Client
+	endpoint *url.URL
+}
+
+// NewClient returns a Client for objects of scheme, configured by config.
+// Requests are sent with c, whose transport is wrapped to sign them.
+// If c is nil, http.DefaultClient is used.
+func NewClient(c *http.Client, scheme string, config Config) (*Client, error) {
+	if c == nil {
+		c = http.DefaultClient
+	}
+
+	endpoint := config.Endpoint
+	switch scheme {
+	case SchemeS3:
+		if config.Region == "" {
+			config.Region = defaultS3Region
+		}
+	case SchemeGCS:
+		config.Region = "auto"
+		if endpoint == "" {
+			endpoint = defaultGCSEndpoint
+		}
+	default:
+		return nil, fmt.Errorf("objstore: unsupported scheme %s", scheme)
+	}
+
+	client := &Client{scheme: scheme, config: config}
+	if endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("objstore: invalid endpoint %s: %w", endpoint, err)
+		}
+		client.endpoint = u
+	}
+
+	signed := *c
+	if config.Credentials.AccessKeyID != "" {
+		client.signer = &Signer{Credentials: config.Credentials, Region: config.Region, Service: "s3"}
+		signed.Transport = client.signer.Transport(c.Transport)
+	}
+	client.client = &signed
+	return client, nil
+}
+
+// NewClientFromEnv returns a Client for objects of scheme configured by
+// ConfigFromEnv.
+func NewClientFromEnv(c *http.Client, scheme string) (*Client, error) {
+	config, err := ConfigFromEnv(scheme)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(c, scheme, config)
+}
+
+// HTTPClient returns the client that signs requests, to use with chonker.Do.
+func (c *Client) HTTPClient() *http.Client {
+	return c.client
+}
+
+// URL returns the HTTP URL of the object named by uri.
+func (c *Client) URL(uri string) (*url.URL, error) {
+	scheme, bucket, key, err := ParseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	if scheme != c.scheme {
+		return nil, fmt.Errorf("%w: %s is not a %s:// URI", ErrInvalidURI, uri, c.scheme)
+	}
+
+	var u url.URL
+	path := "/" + key
+	switch {
+	case c.endpoint != nil:
+		u = *c.endpoint
+		path = strings.TrimSuffix(u.Path, "/") + "/" + bucket + path
+	case strings.Contains(bucket, "."):
+		// Virtual-hosted buckets with dots don't match the TLS certificate.
+		u = url.URL{Scheme: "https", Host: "s3." + c.config.Region + ".amazonaws.com"}
+		path = "/" + bucket + path
+	default:
+		u = url.URL{Scheme: "https", Host: bucket + ".s3." + c.config.Region + ".amazonaws.com"}
+	}
+	u.Path = path
+	u.RawPath = uriEncode(path, false)
+	return &u, nil
+}
+
+// ObjectInfo describes an object.
+type ObjectInfo struct {
+	// URL is the HTTP URL of the object.
+	URL *url.URL
+	// Size is the size of the object in bytes.
+	Size uint64
+	// ETag is the entity tag of the object.
+	ETag string
+	// PartSize is the size of the parts the object was uploaded in,
+	// or zero if it wasn't uploaded in parts of equal size.
+	PartSize uint64
+	// Checksum is the checksum of the whole object, if any.
+	Checksum *Checksum
+}
+
+// Stat returns information about the object named by uri.
+func (c *Client) Stat(ctx context.Context, uri string) (*ObjectInfo, error) {
+	u, err := c.URL(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.head(ctx, u, 0)
+	if err != nil {
+		return nil, err
+	}
+	info := &ObjectInfo{
+		URL:      u,
+		Size:     uint64(resp.ContentLength),
+		ETag:     resp.Header.Get("ETag"),
+		Checksum: checksumFromHeader(resp.Header),
+	}
+
+	// The ETag of a multipart upload encodes its part count, and the size of
+	// its first part is the size of all parts but the last.
+	// Only S3 supports fetching parts.
+	if parts := chonker.MultipartPartCount(info.ETag); c.scheme == SchemeS3 && parts > 1 {
+		part, err := c.head(ctx, u, 1)
+		if err != nil {
+			return nil, err
+		}
+		if n, err := strconv.Atoi(part.Header.Get(headerNameAmzPartsCount)); err == nil && n > 0 {
+			parts = n
+		}
+		size := uint64(part.ContentLength)
+		if n := uint64(parts); size > 0 && (n-1)*size < info.Size && info.Size <= n*size {
+			info.PartSize = size
+		}
+	}
+	return info, nil
+}
+
+// head sends a HEAD request for the object at u, or for its part if
+// part is not zero.
+func (c *Client) head(ctx context.Context, u *url.URL, part int) (*http.Response, error) {
+	if part != 0 {
+		partURL := *u
+		partURL.RawQuery = "partNumber=" + strconv.Itoa(part)
+		u = &partURL
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.scheme == SchemeS3 {
+		req.Header.Set(headerNameAmzChecksumMode, "ENABLED")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("objstore: HEAD %s: unexpected status %s", u, resp.Status)
+	}
+	if resp.ContentLength < 0 {
+		return nil, fmt.Errorf("objstore: HEAD %s: missing Content-Length", u)
+	}
+	return resp, nil
+}
+
+// NewRequest returns a chonker request for the object described by info.
+// If the object was uploaded in parts of equal size, chunks are its parts,
+// and chunkSize is ignored.
+func (c *Client) NewRequest(ctx context.Context, info *ObjectInfo, chunkSize uint64, workers uint) (*chonker.Request, error) {
+	req, err := chonker.NewRequestWithContext(ctx, http.MethodGet, info.URL.String(), nil, chunkSize, workers)
+	if err != nil {
+		return nil, err
+	}
+	if info.PartSize != 0 {
+		planner, err := chonker.NewPartChunkPlanner([]uint64{info.PartSize}, 0)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithChunkPlanner(planner)
+	}
+	return req.WithKnownSize(info.Size, info.ETag), nil
+}
+
+// Get fetches the object named by uri in chunks.
+// If the object has a full-object checksum, reading the body fails with
+// ErrChecksumMismatch if the content does not match it.
+func (c *Client) Get(ctx context.Context, uri string, chunkSize uint64, workers uint) (*http.Response, error) {
+	info, err := c.Stat(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	req, err := c.NewRequest(ctx, info, chunkSize, workers)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := chonker.Do(c.client, req)
+	if err != nil {
+		return nil, err
+	}
+	if info.Checksum != nil {
+		body, err := newVerifyingBody(resp.Body, info.Checksum)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		resp.Body = body
+	}
+	return resp, nil
+}
+
+// Presign returns a URL that grants GET requests for the object named by uri
+// for expires, which chonker can fetch without credentials.
+func (c *Client) Presign(uri string, expires time.Duration) (string, error) {
+	u, err := c.URL(uri)
+	if err != nil {
+		return "", err
+	}
+	if c.signer == nil {
+		return u.String(), nil
+	}
+	return c.signer.Presign(http.MethodGet, u, expires).String(), nil
+}
+
+// URLRefresher returns a chonker.URLRefresher that presigns the object named
+// by uri again for expires, so that downloads from URLs returned by Presign
+// can outlive them.
+func (c *Client) URLRefresher(uri string, expires time.Duration) chonker.URLRefresher {
+	return func(context.Context, *url.URL) (*url.URL, error) {
+		u, err := c.Presign(uri, expires)
+		if err != nil {
+			return nil, err
+		}
+		return url.Parse(u)
+	}
+}
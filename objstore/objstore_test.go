@@ -0,0 +1,215 @@
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testCredentials = Credentials{AccessKeyID: "minio", SecretAccessKey: "minio123"}
+
+// objectServer is a stand-in for an S3 compatible service like MinIO that
+// serves one object uploaded in parts, and checks the signatures of requests.
+type objectServer struct {
+	content  []byte
+	partSize int
+	checksum string
+	// region is the region signatures are checked for.
+	region string
+	// header is the name of the header the checksum is sent in.
+	header string
+
+	mu     sync.Mutex
+	ranges []string
+}
+
+func (s *objectServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.verify(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.URL.Path != "/bucket/dir/my file.bin" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	parts := (len(s.content) + s.partSize - 1) / s.partSize
+	w.Header().Set("ETag", fmt.Sprintf(`"abc-%d"`, parts))
+	w.Header().Set("Accept-Ranges", "bytes")
+	if r.Header.Get("X-Amz-Checksum-Mode") == "ENABLED" || s.header == "X-Goog-Hash" {
+		w.Header().Set(s.header, s.checksum)
+	}
+
+	if r.URL.Query().Get("partNumber") == "1" {
+		w.Header().Set("X-Amz-Mp-Parts-Count", fmt.Sprint(parts))
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", s.partSize-1, len(s.content)))
+		w.Header().Set("Content-Length", fmt.Sprint(s.partSize))
+		w.WriteHeader(http.StatusPartialContent)
+		return
+	}
+	if rng := r.Header.Get("Range"); rng != "" {
+		s.mu.Lock()
+		s.ranges = append(s.ranges, rng)
+		s.mu.Unlock()
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(s.content))
+}
+
+// verify checks the signature of r by signing a copy of it again.
+func (s *objectServer) verify(r *http.Request) bool {
+	t, err := time.Parse(sigV4TimeFormat, r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return false
+	}
+	signer := &Signer{Credentials: testCredentials, Region: s.region, Service: "s3", now: func() time.Time { return t }}
+	req := r.Clone(context.Background())
+	req.URL.Host = r.Host
+	req.Header.Del("Authorization")
+	req.Header.Del("Accept-Encoding")
+	req.Header.Del("User-Agent")
+	signer.Sign(req)
+	return req.Header.Get("Authorization") == r.Header.Get("Authorization")
+}
+
+func crc32Checksum(b []byte) string {
+	sum := crc32.ChecksumIEEE(b)
+	return base64.StdEncoding.EncodeToString([]byte{byte(sum >> 24), byte(sum >> 16), byte(sum >> 8), byte(sum)})
+}
+
+func crc32cChecksum(b []byte) string {
+	sum := crc32.Checksum(b, crc32.MakeTable(crc32.Castagnoli))
+	return base64.StdEncoding.EncodeToString([]byte{byte(sum >> 24), byte(sum >> 16), byte(sum >> 8), byte(sum)})
+}
+
+func makeContent(size int) []byte {
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}
+
+func TestClient_Get(t *testing.T) {
+	content := makeContent(1000)
+	server := httptest.NewServer(&objectServer{
+		content:  content,
+		partSize: 300,
+		checksum: crc32Checksum(content),
+		region:   "us-east-1",
+		header:   "X-Amz-Checksum-Crc32",
+	})
+	defer server.Close()
+	handler := server.Config.Handler.(*objectServer)
+
+	client, err := NewClient(nil, SchemeS3, Config{Credentials: testCredentials, Endpoint: server.URL})
+	assert.NoError(t, err)
+
+	info, err := client.Stat(context.Background(), "s3://bucket/dir/my file.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1000), info.Size)
+	assert.Equal(t, uint64(300), info.PartSize)
+	assert.Equal(t, &Checksum{Algorithm: "CRC32", Value: crc32Checksum(content)}, info.Checksum)
+
+	resp, err := client.Get(context.Background(), "s3://bucket/dir/my file.bin", 64, 2)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	got, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, content, got)
+
+	// Chunks are aligned to parts.
+	assert.ElementsMatch(t, []string{"bytes=0-299", "bytes=300-599", "bytes=600-899", "bytes=900-999"}, handler.ranges)
+}
+
+func TestClient_GetChecksumMismatch(t *testing.T) {
+	content := makeContent(1000)
+	server := httptest.NewServer(&objectServer{
+		content:  content,
+		partSize: 1000,
+		checksum: "crc32c=" + crc32cChecksum(content[1:]) + ",md5=AAAA",
+		region:   "auto",
+		header:   "X-Goog-Hash",
+	})
+	defer server.Close()
+
+	client, err := NewClient(nil, SchemeGCS, Config{Credentials: testCredentials, Endpoint: server.URL})
+	assert.NoError(t, err)
+
+	resp, err := client.Get(context.Background(), "gs://bucket/dir/my file.bin", 64, 2)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	_, err = io.ReadAll(resp.Body)
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+}
+
+func TestClient_Unsigned(t *testing.T) {
+	server := httptest.NewServer(&objectServer{content: makeContent(10), partSize: 10})
+	defer server.Close()
+
+	client, err := NewClient(nil, SchemeS3, Config{Endpoint: server.URL})
+	assert.NoError(t, err)
+	_, err = client.Stat(context.Background(), "s3://bucket/dir/my file.bin")
+	assert.ErrorContains(t, err, "403 Forbidden")
+}
+
+func TestClient_URL(t *testing.T) {
+	s3, err := NewClient(nil, SchemeS3, Config{Region: "eu-west-1"})
+	assert.NoError(t, err)
+	gcs, err := NewClient(nil, SchemeGCS, Config{})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		client *Client
+		uri    string
+		want   string
+		err    bool
+	}{
+		{s3, "s3://bucket/a/b c", "https://bucket.s3.eu-west-1.amazonaws.com/a/b%20c", false},
+		{s3, "s3://my.bucket/key", "https://s3.eu-west-1.amazonaws.com/my.bucket/key", false},
+		{gcs, "gs://bucket/key+1", "https://storage.googleapis.com/bucket/key%2B1", false},
+		{s3, "gs://bucket/key", "", true},
+		{s3, "s3://bucket", "", true},
+		{s3, "https://bucket/key", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.uri, func(t *testing.T) {
+			u, err := tt.client.URL(tt.uri)
+			if tt.err {
+				assert.ErrorIs(t, err, ErrInvalidURI)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, u.String())
+		})
+	}
+}
+
+func TestClient_Presign(t *testing.T) {
+	client, err := NewClient(nil, SchemeS3, Config{Credentials: testCredentials})
+	assert.NoError(t, err)
+	u, err := client.Presign("s3://bucket/key", time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(u, "https://bucket.s3.us-east-1.amazonaws.com/key?X-Amz-Algorithm="))
+	assert.Contains(t, u, "X-Amz-Expires=3600")
+	assert.Contains(t, u, "&X-Amz-Signature=")
+}
+
+func TestClient_URLRefresher(t *testing.T) {
+	client, err := NewClient(nil, SchemeS3, Config{Credentials: testCredentials})
+	assert.NoError(t, err)
+	u, err := client.URLRefresher("s3://bucket/key", time.Hour)(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "bucket.s3.us-east-1.amazonaws.com", u.Host)
+	assert.Equal(t, "3600", u.Query().Get("X-Amz-Expires"))
+}
@@ -0,0 +1,724 @@
+package chonker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultChunkSize is the chunk size of requests unless configured otherwise.
+	DefaultChunkSize = 1024 * 1024
+	// DefaultWorkers is the number of chunks fetched concurrently unless
+	// configured otherwise.
+	DefaultWorkers = 4
+)
+
+// Config holds the settings of ranged requests.
+// Options change a Config, and a Config can be loaded from JSON with
+// LoadConfig or from environment variables with ConfigFromEnv.
+// Settings that aren't data, like the logger, can only be set with options.
+type Config struct {
+	// ChunkSize is the size of chunks in bytes.
+	ChunkSize uint64
+	// Workers is the maximum number of chunks fetched concurrently.
+	Workers uint
+	// OpportunisticRange is the setting of Request.WithOpportunisticRange.
+	OpportunisticRange bool
+	// RangeRecovery is the setting of Request.WithRangeRecovery.
+	RangeRecovery bool
+	// ContentDecoding is the setting of Request.WithContentDecoding.
+	ContentDecoding bool
+	// ProbeStrategy is the setting of Request.WithProbeStrategy.
+	ProbeStrategy ProbeStrategy
+	// RedirectResolution is the setting of Request.WithRedirectResolution.
+	RedirectResolution RedirectResolution
+	// Connections is the setting of Request.WithConnections.
+	Connections Connections
+	// Retry configures how failed chunks are retried.
+	Retry Retry
+	// ChunkTimeouts is the setting of Request.WithChunkTimeouts.
+	// The zero value disables chunk timeouts.
+	ChunkTimeouts ChunkTimeouts
+	// ReadAhead and HedgeAfter are the settings of Request.WithReadAhead.
+	ReadAhead  uint64
+	HedgeAfter time.Duration
+
+	// Hedging is the setting of Request.WithHedging, if not nil.
+	Hedging *Hedging
+	// ChunkPlanner is the setting of Request.WithChunkPlanner, if not nil.
+	ChunkPlanner ChunkPlanner
+	// ProbeCache is the setting of Request.WithProbeCache, if not nil.
+	ProbeCache ProbeCache
+	// ChunkCache is the setting of Request.WithChunkCache, if not nil.
+	ChunkCache *ChunkCache
+	// CacheKey is the setting of Request.WithCacheKey.
+	CacheKey string
+	// URLRefresher is the setting of Request.WithURLRefresher, if not nil.
+	URLRefresher URLRefresher
+	// Logger logs retries, hedges, and failures of chunks, if not nil.
+	Logger *slog.Logger
+	// MinSize is the setting of Request.WithMinSize.
+	MinSize uint64
+	// ContentTypes is the setting of Request.WithContentTypes.
+	ContentTypes []string
+	// Methods are the methods of requests that a RoundTripper from
+	// NewRoundTripperWithOptions fetches in chunks, if not empty.
+	// Requests with other methods are sent as they are.
+	Methods []string
+	// URLPattern matches the URLs of requests that a RoundTripper from
+	// NewRoundTripperWithOptions fetches in chunks, if not nil.
+	// Requests to other URLs are sent as they are.
+	URLPattern *regexp.Regexp
+
+	// Bypass sends requests through a RoundTripper from
+	// NewRoundTripperWithOptions as they are, without fetching them in chunks.
+	// It is meant for small API calls made with WithRequestOptions.
+	Bypass bool
+}
+
+// Retry configures how chunks that fail with a network error or a 429 or 5xx
+// status are retried. The rest of a chunk is fetched again, after a backoff
+// that doubles with each attempt.
+type Retry struct {
+	// Attempts is the maximum number of attempts to fetch a chunk.
+	// Zero and one disable retries.
+	Attempts int
+	// Backoff is the time to wait before the first retry.
+	Backoff time.Duration
+}
+
+// Option configures ranged requests.
+type Option func(*Config)
+
+// DefaultConfig returns the default configuration, which fetches four 1MiB
+// chunks concurrently.
+func DefaultConfig() Config {
+	return Config{ChunkSize: DefaultChunkSize, Workers: DefaultWorkers}
+}
+
+// NewConfig returns the default configuration changed by opts.
+func NewConfig(opts ...Option) Config {
+	cfg := DefaultConfig()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// WithConfig replaces the configuration with cfg.
+// Options after it change cfg.
+func WithConfig(cfg Config) Option {
+	return func(c *Config) { *c = cfg }
+}
+
+// WithChunkSize sets the size of chunks in bytes.
+func WithChunkSize(n uint64) Option {
+	return func(c *Config) { c.ChunkSize = n }
+}
+
+// WithWorkers sets the maximum number of chunks fetched concurrently.
+func WithWorkers(n uint) Option {
+	return func(c *Config) { c.Workers = n }
+}
+
+// WithRetry retries failed chunks up to attempts times in total,
+// waiting backoff before the first retry and twice as long before each next one.
+func WithRetry(attempts int, backoff time.Duration) Option {
+	return func(c *Config) { c.Retry = Retry{Attempts: attempts, Backoff: backoff} }
+}
+
+// WithLogger logs retries, hedges, and failures of chunks to l.
+func WithLogger(l *slog.Logger) Option {
+	return func(c *Config) { c.Logger = l }
+}
+
+// WithOpportunisticRange succeeds requests to servers that don't support
+// range requests. See Request.WithOpportunisticRange.
+func WithOpportunisticRange() Option {
+	return func(c *Config) { c.OpportunisticRange = true }
+}
+
+// WithRangeRecovery recovers chunks answered with the whole content.
+// See Request.WithRangeRecovery.
+func WithRangeRecovery() Option {
+	return func(c *Config) { c.RangeRecovery = true }
+}
+
+// WithContentDecoding fetches and decodes encoded content.
+// See Request.WithContentDecoding.
+func WithContentDecoding() Option {
+	return func(c *Config) { c.ContentDecoding = true }
+}
+
+// WithProbeStrategy sets how servers are probed. See Request.WithProbeStrategy.
+func WithProbeStrategy(s ProbeStrategy) Option {
+	return func(c *Config) { c.ProbeStrategy = s }
+}
+
+// WithRedirectResolution sets how chunk requests deal with redirects.
+// See Request.WithRedirectResolution.
+func WithRedirectResolution(m RedirectResolution) Option {
+	return func(c *Config) { c.RedirectResolution = m }
+}
+
+// WithConnections sets how chunks are spread over connections.
+// See Request.WithConnections.
+func WithConnections(conns Connections) Option {
+	return func(c *Config) { c.Connections = conns }
+}
+
+// WithChunkCache serves chunks from cache, and stores fetched chunks there.
+// See Request.WithChunkCache.
+func WithChunkCache(cache *ChunkCache) Option {
+	return func(c *Config) { c.ChunkCache = cache }
+}
+
+// WithCacheKey sets the key that chunks are cached by.
+// See Request.WithCacheKey.
+func WithCacheKey(key string) Option {
+	return func(c *Config) { c.CacheKey = key }
+}
+
+// WithURLRefresher refreshes expiring presigned URLs.
+// See Request.WithURLRefresher.
+func WithURLRefresher(refresh URLRefresher) Option {
+	return func(c *Config) { c.URLRefresher = refresh }
+}
+
+// WithProbeCache caches probe results in pc. See Request.WithProbeCache.
+func WithProbeCache(pc ProbeCache) Option {
+	return func(c *Config) { c.ProbeCache = pc }
+}
+
+// WithChunkPlanner sets how content is divided into chunks.
+// See Request.WithChunkPlanner.
+func WithChunkPlanner(p ChunkPlanner) Option {
+	return func(c *Config) { c.ChunkPlanner = p }
+}
+
+// WithReadAhead bounds how far ahead of the reader chunks are fetched.
+// See Request.WithReadAhead.
+func WithReadAhead(window uint64, hedgeAfter time.Duration) Option {
+	return func(c *Config) { c.ReadAhead, c.HedgeAfter = window, hedgeAfter }
+}
+
+// WithHedging hedges slow chunks. See Request.WithHedging.
+func WithHedging(h Hedging) Option {
+	return func(c *Config) { c.Hedging = &h }
+}
+
+// WithChunkTimeouts detects stalled chunks. See Request.WithChunkTimeouts.
+func WithChunkTimeouts(t ChunkTimeouts) Option {
+	return func(c *Config) { c.ChunkTimeouts = t }
+}
+
+// WithMinSize skips chunking content smaller than size bytes.
+// See Request.WithMinSize.
+func WithMinSize(size uint64) Option {
+	return func(c *Config) { c.MinSize = size }
+}
+
+// WithContentTypes only fetches content of the given media types in chunks.
+// See Request.WithContentTypes.
+func WithContentTypes(types ...string) Option {
+	return func(c *Config) { c.ContentTypes = types }
+}
+
+// WithMethods only fetches requests with the given methods in chunks.
+// See Config.Methods.
+func WithMethods(methods ...string) Option {
+	return func(c *Config) { c.Methods = methods }
+}
+
+// WithURLPattern only fetches requests to URLs matching pattern in chunks.
+// See Config.URLPattern.
+func WithURLPattern(pattern *regexp.Regexp) Option {
+	return func(c *Config) { c.URLPattern = pattern }
+}
+
+// WithBypass sends requests as they are, without fetching them in chunks.
+// See Config.Bypass.
+func WithBypass() Option {
+	return func(c *Config) { c.Bypass = true }
+}
+
+// requestOptionsKey is the context key of the options added by WithRequestOptions.
+type requestOptionsKey struct{}
+
+// WithRequestOptions returns a copy of ctx carrying opts, which a RoundTripper
+// from NewRoundTripperWithOptions applies to requests with that context,
+// after its own options. Options added to a context that already carries
+// options are applied after them.
+//
+// Use it to configure a single request sent with a chonker client:
+//
+//	ctx := chonker.WithRequestOptions(ctx, chonker.WithWorkers(16))
+//	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+func WithRequestOptions(ctx context.Context, opts ...Option) context.Context {
+	prev := requestOptions(ctx)
+	all := make([]Option, 0, len(prev)+len(opts))
+	all = append(append(all, prev...), opts...)
+	return context.WithValue(ctx, requestOptionsKey{}, all)
+}
+
+// requestOptions returns the options added to ctx by WithRequestOptions.
+func requestOptions(ctx context.Context) []Option {
+	opts, _ := ctx.Value(requestOptionsKey{}).([]Option)
+	return opts
+}
+
+func (c Config) validate() error {
+	if c.ChunkSize < 1 || c.Workers < 1 {
+		return ErrInvalidArgument
+	}
+	return nil
+}
+
+// filters reports whether a RoundTripper configured with c fetches req in chunks.
+func (c Config) filters(req *http.Request) bool {
+	if c.Bypass {
+		return false
+	}
+	if len(c.Methods) > 0 && !slices.Contains(c.Methods, req.Method) {
+		return false
+	}
+	return c.URLPattern == nil || c.URLPattern.MatchString(req.URL.String())
+}
+
+// configure applies c to r.
+func (c Config) configure(r *Request) {
+	r.chunkSize = c.ChunkSize
+	r.workers = c.Workers
+	r.continueWithoutRange = c.OpportunisticRange
+	r.recoverRange = c.RangeRecovery
+	r.decodeContent = c.ContentDecoding
+	r.probeStrategy = c.ProbeStrategy
+	r.redirects = c.RedirectResolution
+	r.refresher = c.URLRefresher
+	r.connections = c.Connections
+	r.cache = c.ChunkCache
+	r.cacheKey = c.CacheKey
+	r.retry = c.Retry
+	if c.ChunkTimeouts != (ChunkTimeouts{}) {
+		t := c.ChunkTimeouts
+		r.chunkTimeouts = &t
+	}
+	r.readAhead = c.ReadAhead
+	r.hedgeAfter = c.HedgeAfter
+	r.hedging = c.Hedging
+	r.planner = c.ChunkPlanner
+	r.probeCache = c.ProbeCache
+	r.log = c.Logger
+	r.minSize = c.MinSize
+	r.contentTypes = c.ContentTypes
+}
+
+// NewRequestWithOptions returns a new Request configured by opts.
+// It is a wrapper around http.NewRequestWithContext that adds support for ranged requests.
+// If the chunk size or number of workers is zero, ErrInvalidArgument is returned.
+func NewRequestWithOptions(
+	ctx context.Context,
+	method, url string,
+	body io.Reader,
+	opts ...Option,
+) (*Request, error) {
+	cfg := NewConfig(opts...)
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	r := &Request{Request: req}
+	cfg.configure(r)
+	return r, nil
+}
+
+// NewClientWithOptions returns a new http.Client that fetches requests in chunks.
+// The returned client's Transport is a http.RoundTripper from
+// NewRoundTripperWithOptions, which sends chunks with the Transport of c.
+//
+// The returned client keeps the CheckRedirect and Timeout policies of c,
+// and the Jar of c is used for every request it sends, probes and chunks
+// included, and for the redirects they follow. Its own Jar is nil, so that
+// cookies aren't added twice. Redirects of chunks follow CheckRedirect.
+// Timeout limits each chunk instead of the whole download, so that long
+// downloads aren't cut short, and content that is fetched whole, from servers
+// that don't support range requests, isn't limited by it. Requests that
+// aren't fetched in chunks at all, because of WithBypass or the filters of
+// opts, are sent with the Timeout of c, as if sent by c.
+//
+// Middlewares that should see every chunk, like retries or authentication,
+// wrap the Transport of c. Middlewares that should see whole downloads,
+// like logging, wrap the Transport of the returned client.
+func NewClientWithOptions(c *http.Client, opts ...Option) (*http.Client, error) {
+	var outer, inner http.Client
+	if c != nil {
+		outer = *c
+		inner = http.Client{Transport: c.Transport, CheckRedirect: c.CheckRedirect, Jar: c.Jar, Timeout: c.Timeout}
+	}
+	transport, err := newRoundTripper(&inner, true, opts...)
+	if err != nil {
+		return nil, err
+	}
+	outer.Transport = transport
+	outer.Jar = nil
+	outer.Timeout = 0
+	return &outer, nil
+}
+
+// NewRoundTripperWithOptions returns a new http.RoundTripper that fetches
+// requests in chunks, configured by opts.
+// Unless a probe cache is configured, probe results are cached for up to
+// DefaultProbeCacheTTL and shared by every request sent through the returned
+// http.RoundTripper.
+// Options added to the context of a request with WithRequestOptions
+// override opts for that request.
+func NewRoundTripperWithOptions(c *http.Client, opts ...Option) (http.RoundTripper, error) {
+	return newRoundTripper(c, false, opts...)
+}
+
+// newRoundTripper returns the http.RoundTripper of NewRoundTripperWithOptions.
+// If inner is true, c stands in for the client returned by
+// NewClientWithOptions: requests that aren't fetched in chunks are sent with
+// sendUnchunked, and whole content isn't limited by the Timeout of c.
+// Otherwise, they are sent with the Transport of c.
+func newRoundTripper(c *http.Client, inner bool, opts ...Option) (http.RoundTripper, error) {
+	base := NewConfig(opts...)
+	if err := base.validate(); err != nil {
+		return nil, err
+	}
+	if base.ProbeCache == nil {
+		base.ProbeCache = NewProbeCache(DefaultProbeCacheTTL)
+	}
+	return roundTripper(func(r *http.Request) (*http.Response, error) {
+		cfg := base
+		for _, opt := range requestOptions(r.Context()) {
+			opt(&cfg)
+		}
+		if !cfg.filters(r) {
+			if inner {
+				return sendUnchunked(c, r)
+			}
+			return transport(c).RoundTrip(r)
+		}
+		if err := cfg.validate(); err != nil {
+			return nil, err
+		}
+		req := &Request{Request: r, untimedWhole: inner}
+		cfg.configure(req)
+		return Do(c, req)
+	}), nil
+}
+
+// sendUnchunked sends r with the Transport of c, with the cookies of the Jar
+// of c and within the Timeout of c, like c would send it. Unlike c, it doesn't
+// follow redirects, which are left to the client that r was sent with.
+func sendUnchunked(c *http.Client, r *http.Request) (*http.Response, error) {
+	if c.Jar != nil {
+		r = r.Clone(r.Context())
+		for _, cookie := range c.Jar.Cookies(r.URL) {
+			r.AddCookie(cookie)
+		}
+	}
+	cancel := context.CancelFunc(func() {})
+	if c.Timeout > 0 {
+		var ctx context.Context
+		ctx, cancel = context.WithTimeout(r.Context(), c.Timeout)
+		r = r.WithContext(ctx)
+	}
+	resp, err := transport(c).RoundTrip(r)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if c.Jar != nil {
+		if cookies := resp.Cookies(); len(cookies) > 0 {
+			c.Jar.SetCookies(r.URL, cookies)
+		}
+	}
+	resp.Body = &cancelOnCloseBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// transport returns the http.RoundTripper that c sends requests with.
+func transport(c *http.Client) http.RoundTripper {
+	if c != nil && c.Transport != nil {
+		return c.Transport
+	}
+	return http.DefaultTransport
+}
+
+// configJSON is the JSON representation of a Config.
+type configJSON struct {
+	ChunkSize          uint64             `json:"chunkSize"`
+	Workers            uint               `json:"workers"`
+	OpportunisticRange bool               `json:"opportunisticRange"`
+	RangeRecovery      bool               `json:"rangeRecovery"`
+	ContentDecoding    bool               `json:"contentDecoding"`
+	ProbeStrategy      ProbeStrategy      `json:"probeStrategy"`
+	RedirectResolution RedirectResolution `json:"redirectResolution"`
+	Connections        struct {
+		Strategy   ConnectionStrategy `json:"strategy"`
+		Count      int                `json:"count"`
+		LocalAddrs []net.IP           `json:"localAddrs"`
+		Interfaces []string           `json:"interfaces"`
+		FanOut     bool               `json:"fanOut"`
+	} `json:"connections"`
+	Retry struct {
+		Attempts int      `json:"attempts"`
+		Backoff  duration `json:"backoff"`
+	} `json:"retry"`
+	ChunkTimeouts struct {
+		FirstByte        duration `json:"firstByte"`
+		Idle             duration `json:"idle"`
+		MinThroughput    float64  `json:"minThroughput"`
+		ThroughputWindow duration `json:"throughputWindow"`
+		Retries          int      `json:"retries"`
+	} `json:"chunkTimeouts"`
+	ChunkCache struct {
+		Dir     string `json:"dir"`
+		MaxSize int64  `json:"maxSize"`
+	} `json:"chunkCache"`
+	ReadAhead    uint64   `json:"readAhead"`
+	HedgeAfter   duration `json:"hedgeAfter"`
+	MinSize      uint64   `json:"minSize"`
+	ContentTypes []string `json:"contentTypes"`
+	Methods      []string `json:"methods"`
+	URLPattern   string   `json:"urlPattern"`
+}
+
+// discardLogger discards all logs.
+var discardLogger = slog.New(discardHandler{})
+
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// duration is a time.Duration written as a string like "1m30s" in JSON.
+type duration time.Duration
+
+func (d *duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	*d = duration(v)
+	return err
+}
+
+// LoadConfig reads a Config from JSON like
+//
+//	{"chunkSize": 4194304, "workers": 8, "probeStrategy": "head",
+//	 "retry": {"attempts": 3, "backoff": "100ms"}}
+//
+// Settings missing from the JSON keep their default values.
+func LoadConfig(r io.Reader) (Config, error) {
+	cfg := DefaultConfig()
+	j := configJSON{ChunkSize: cfg.ChunkSize, Workers: cfg.Workers}
+	if err := json.NewDecoder(r).Decode(&j); err != nil {
+		return Config{}, fmt.Errorf("chonker: error decoding config: %w", err)
+	}
+	cfg.ChunkSize = j.ChunkSize
+	cfg.Workers = j.Workers
+	cfg.OpportunisticRange = j.OpportunisticRange
+	cfg.RangeRecovery = j.RangeRecovery
+	cfg.ContentDecoding = j.ContentDecoding
+	cfg.ProbeStrategy = j.ProbeStrategy
+	cfg.RedirectResolution = j.RedirectResolution
+	cfg.Connections = Connections{
+		Strategy:   j.Connections.Strategy,
+		Count:      j.Connections.Count,
+		LocalAddrs: j.Connections.LocalAddrs,
+		Interfaces: j.Connections.Interfaces,
+	}
+	if j.Connections.FanOut {
+		cfg.Connections.Resolver = net.DefaultResolver
+	}
+	cfg.Retry = Retry{Attempts: j.Retry.Attempts, Backoff: time.Duration(j.Retry.Backoff)}
+	cfg.ChunkTimeouts = ChunkTimeouts{
+		FirstByte:        time.Duration(j.ChunkTimeouts.FirstByte),
+		Idle:             time.Duration(j.ChunkTimeouts.Idle),
+		MinThroughput:    j.ChunkTimeouts.MinThroughput,
+		ThroughputWindow: time.Duration(j.ChunkTimeouts.ThroughputWindow),
+		Retries:          j.ChunkTimeouts.Retries,
+	}
+	cfg.ReadAhead = j.ReadAhead
+	cfg.HedgeAfter = time.Duration(j.HedgeAfter)
+	if j.ChunkCache.Dir != "" {
+		var err error
+		if cfg.ChunkCache, err = NewChunkCache(j.ChunkCache.Dir, j.ChunkCache.MaxSize); err != nil {
+			return Config{}, err
+		}
+	}
+	cfg.MinSize = j.MinSize
+	cfg.ContentTypes = j.ContentTypes
+	cfg.Methods = j.Methods
+	if j.URLPattern != "" {
+		var err error
+		if cfg.URLPattern, err = regexp.Compile(j.URLPattern); err != nil {
+			return Config{}, fmt.Errorf("chonker: invalid URL pattern: %w", err)
+		}
+	}
+	return cfg, cfg.validate()
+}
+
+// ConfigFromEnv reads a Config from the environment variables
+// CHONKER_CHUNK_SIZE, CHONKER_WORKERS, CHONKER_OPPORTUNISTIC_RANGE,
+// CHONKER_RANGE_RECOVERY, CHONKER_CONTENT_DECODING, CHONKER_PROBE_STRATEGY,
+// CHONKER_REDIRECT_RESOLUTION, CHONKER_CONNECTIONS, CHONKER_CONNECTION_COUNT,
+// CHONKER_LOCAL_ADDRS, CHONKER_INTERFACES, CHONKER_FAN_OUT,
+// CHONKER_RETRY_ATTEMPTS, CHONKER_RETRY_BACKOFF, CHONKER_CHUNK_FIRST_BYTE_TIMEOUT,
+// CHONKER_CHUNK_IDLE_TIMEOUT, CHONKER_CHUNK_MIN_THROUGHPUT, CHONKER_CHUNK_RETRIES,
+// CHONKER_READ_AHEAD, CHONKER_HEDGE_AFTER, CHONKER_MIN_SIZE,
+// CHONKER_CONTENT_TYPES, CHONKER_METHODS, CHONKER_URL_PATTERN,
+// CHONKER_CACHE_DIR, and CHONKER_CACHE_MAX_SIZE.
+// Sizes are in bytes, durations are strings like "1m30s", and lists are
+// separated by commas.
+// Unset variables keep their default values.
+func ConfigFromEnv() (Config, error) {
+	cfg := DefaultConfig()
+	vars := []struct {
+		name  string
+		parse func(string) error
+	}{
+		{"CHONKER_CHUNK_SIZE", parseUint(&cfg.ChunkSize)},
+		{"CHONKER_WORKERS", func(s string) error {
+			n, err := strconv.ParseUint(s, 10, 0)
+			cfg.Workers = uint(n)
+			return err
+		}},
+		{"CHONKER_OPPORTUNISTIC_RANGE", parseBool(&cfg.OpportunisticRange)},
+		{"CHONKER_RANGE_RECOVERY", parseBool(&cfg.RangeRecovery)},
+		{"CHONKER_CONTENT_DECODING", parseBool(&cfg.ContentDecoding)},
+		{"CHONKER_PROBE_STRATEGY", func(s string) error {
+			return cfg.ProbeStrategy.UnmarshalText([]byte(s))
+		}},
+		{"CHONKER_REDIRECT_RESOLUTION", func(s string) error {
+			return cfg.RedirectResolution.UnmarshalText([]byte(s))
+		}},
+		{"CHONKER_CONNECTIONS", func(s string) error {
+			return cfg.Connections.Strategy.UnmarshalText([]byte(s))
+		}},
+		{"CHONKER_CONNECTION_COUNT", func(s string) (err error) {
+			cfg.Connections.Count, err = strconv.Atoi(s)
+			return err
+		}},
+		{"CHONKER_LOCAL_ADDRS", func(s string) error {
+			var addrs []string
+			_ = parseList(&addrs)(s)
+			cfg.Connections.LocalAddrs = nil
+			for _, a := range addrs {
+				ip := net.ParseIP(a)
+				if ip == nil {
+					return fmt.Errorf("invalid IP address %q", a)
+				}
+				cfg.Connections.LocalAddrs = append(cfg.Connections.LocalAddrs, ip)
+			}
+			return nil
+		}},
+		{"CHONKER_INTERFACES", parseList(&cfg.Connections.Interfaces)},
+		{"CHONKER_FAN_OUT", func(s string) error {
+			fanOut, err := strconv.ParseBool(s)
+			if fanOut {
+				cfg.Connections.Resolver = net.DefaultResolver
+			}
+			return err
+		}},
+		{"CHONKER_RETRY_ATTEMPTS", func(s string) error {
+			n, err := strconv.Atoi(s)
+			cfg.Retry.Attempts = n
+			return err
+		}},
+		{"CHONKER_RETRY_BACKOFF", parseDuration(&cfg.Retry.Backoff)},
+		{"CHONKER_CHUNK_FIRST_BYTE_TIMEOUT", parseDuration(&cfg.ChunkTimeouts.FirstByte)},
+		{"CHONKER_CHUNK_IDLE_TIMEOUT", parseDuration(&cfg.ChunkTimeouts.Idle)},
+		{"CHONKER_CHUNK_MIN_THROUGHPUT", func(s string) error {
+			v, err := strconv.ParseFloat(s, 64)
+			cfg.ChunkTimeouts.MinThroughput = v
+			return err
+		}},
+		{"CHONKER_CHUNK_RETRIES", func(s string) error {
+			n, err := strconv.Atoi(s)
+			cfg.ChunkTimeouts.Retries = n
+			return err
+		}},
+		{"CHONKER_READ_AHEAD", parseUint(&cfg.ReadAhead)},
+		{"CHONKER_HEDGE_AFTER", parseDuration(&cfg.HedgeAfter)},
+		{"CHONKER_MIN_SIZE", parseUint(&cfg.MinSize)},
+		{"CHONKER_CONTENT_TYPES", parseList(&cfg.ContentTypes)},
+		{"CHONKER_METHODS", parseList(&cfg.Methods)},
+		{"CHONKER_URL_PATTERN", func(s string) (err error) {
+			cfg.URLPattern, err = regexp.Compile(s)
+			return err
+		}},
+	}
+	for _, v := range vars {
+		s, ok := os.LookupEnv(v.name)
+		if !ok {
+			continue
+		}
+		if err := v.parse(s); err != nil {
+			return Config{}, fmt.Errorf("chonker: invalid %s=%q: %w", v.name, s, err)
+		}
+	}
+	if dir := os.Getenv("CHONKER_CACHE_DIR"); dir != "" {
+		maxSize := int64(defaultChunkCacheMaxSize)
+		if s := os.Getenv("CHONKER_CACHE_MAX_SIZE"); s != "" {
+			var err error
+			if maxSize, err = strconv.ParseInt(s, 10, 64); err != nil {
+				return Config{}, fmt.Errorf("chonker: invalid CHONKER_CACHE_MAX_SIZE=%q: %w", s, err)
+			}
+		}
+		var err error
+		if cfg.ChunkCache, err = NewChunkCache(dir, maxSize); err != nil {
+			return Config{}, err
+		}
+	}
+	return cfg, cfg.validate()
+}
+
+func parseUint(dst *uint64) func(string) error {
+	return func(s string) (err error) {
+		*dst, err = strconv.ParseUint(s, 10, 64)
+		return err
+	}
+}
+
+func parseBool(dst *bool) func(string) error {
+	return func(s string) (err error) {
+		*dst, err = strconv.ParseBool(s)
+		return err
+	}
+}
+
+func parseList(dst *[]string) func(string) error {
+	return func(s string) error {
+		*dst = nil
+		for _, v := range strings.Split(s, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				*dst = append(*dst, v)
+			}
+		}
+		return nil
+	}
+}
+
+func parseDuration(dst *time.Duration) func(string) error {
+	return func(s string) (err error) {
+		*dst, err = time.ParseDuration(s)
+		return err
+	}
+}
@@ -0,0 +1,444 @@
+package chonker
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewConfig(t *testing.T) {
+	assert.Equal(t, Config{ChunkSize: DefaultChunkSize, Workers: DefaultWorkers}, NewConfig())
+
+	cfg := NewConfig(
+		WithChunkSize(64),
+		WithWorkers(2),
+		WithRetry(3, time.Second),
+		WithProbeStrategy(ProbeHead),
+		WithRangeRecovery(),
+	)
+	assert.Equal(t, uint64(64), cfg.ChunkSize)
+	assert.Equal(t, uint(2), cfg.Workers)
+	assert.Equal(t, Retry{Attempts: 3, Backoff: time.Second}, cfg.Retry)
+	assert.Equal(t, ProbeHead, cfg.ProbeStrategy)
+	assert.True(t, cfg.RangeRecovery)
+
+	cfg = NewConfig(WithConfig(cfg), WithWorkers(8))
+	assert.Equal(t, uint64(64), cfg.ChunkSize)
+	assert.Equal(t, uint(8), cfg.Workers)
+}
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := LoadConfig(strings.NewReader(`{
+		"workers": 8,
+		"probeStrategy": "head",
+		"retry": {"attempts": 3, "backoff": "100ms"},
+		"chunkTimeouts": {"idle": "5s", "retries": 2},
+		"minSize": 65536,
+		"urlPattern": "\\.iso$"
+	}`))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(DefaultChunkSize), cfg.ChunkSize)
+	assert.Equal(t, uint(8), cfg.Workers)
+	assert.Equal(t, ProbeHead, cfg.ProbeStrategy)
+	assert.Equal(t, Retry{Attempts: 3, Backoff: 100 * time.Millisecond}, cfg.Retry)
+	assert.Equal(t, ChunkTimeouts{Idle: 5 * time.Second, Retries: 2}, cfg.ChunkTimeouts)
+	assert.Equal(t, uint64(65536), cfg.MinSize)
+	if assert.NotNil(t, cfg.URLPattern) {
+		assert.True(t, cfg.URLPattern.MatchString("https://example.com/debian.iso"))
+	}
+
+	for _, in := range []string{
+		`{"workers": 0}`,
+		`{"probeStrategy": "post"}`,
+		`{"retry": {"backoff": "soon"}}`,
+		`{"urlPattern": "("}`,
+		`{"chunkCache": {"dir": "cache"}}`,
+		`[]`,
+	} {
+		_, err := LoadConfig(strings.NewReader(in))
+		assert.Error(t, err, in)
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("CHONKER_CHUNK_SIZE", "4096")
+	t.Setenv("CHONKER_PROBE_STRATEGY", "HEAD")
+	t.Setenv("CHONKER_RETRY_ATTEMPTS", "5")
+	t.Setenv("CHONKER_CHUNK_IDLE_TIMEOUT", "1s")
+	t.Setenv("CHONKER_RANGE_RECOVERY", "true")
+	t.Setenv("CHONKER_METHODS", "GET, HEAD")
+	t.Setenv("CHONKER_CACHE_DIR", t.TempDir())
+	t.Setenv("CHONKER_CACHE_MAX_SIZE", "1048576")
+
+	cfg, err := ConfigFromEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4096), cfg.ChunkSize)
+	assert.Equal(t, uint(DefaultWorkers), cfg.Workers)
+	assert.Equal(t, ProbeHead, cfg.ProbeStrategy)
+	assert.Equal(t, 5, cfg.Retry.Attempts)
+	assert.Equal(t, time.Second, cfg.ChunkTimeouts.Idle)
+	assert.True(t, cfg.RangeRecovery)
+	assert.Equal(t, []string{"GET", "HEAD"}, cfg.Methods)
+	if assert.NotNil(t, cfg.ChunkCache) {
+		assert.Equal(t, int64(1<<20), cfg.ChunkCache.maxSize)
+	}
+
+	t.Setenv("CHONKER_WORKERS", "many")
+	_, err = ConfigFromEnv()
+	assert.ErrorContains(t, err, "CHONKER_WORKERS")
+}
+
+func TestNewRequestWithOptions(t *testing.T) {
+	_, err := NewRequestWithOptions(context.Background(), http.MethodGet, "http://example.com", nil, WithChunkSize(0))
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+	_, err = NewRoundTripperWithOptions(nil, WithWorkers(0))
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+
+	req, err := NewRequestWithOptions(context.Background(), http.MethodGet, "http://example.com", nil,
+		WithChunkSize(64), WithWorkers(2), WithRetry(2, time.Millisecond))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(64), req.chunkSize)
+	assert.Equal(t, uint(2), req.workers)
+	assert.Equal(t, Retry{Attempts: 2, Backoff: time.Millisecond}, req.retry)
+	assert.Nil(t, req.chunkTimeouts)
+}
+
+func TestDo_Retry(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		fails  int
+		retry  Retry
+		// attempts is the number of attempts of the failed chunk, if it fails.
+		attempts int
+	}{
+		{name: "retried", status: http.StatusInternalServerError, fails: 2, retry: Retry{Attempts: 3, Backoff: time.Millisecond}},
+		{name: "too many requests", status: http.StatusTooManyRequests, fails: 1, retry: Retry{Attempts: 2}},
+		{name: "exhausted", status: http.StatusBadGateway, fails: 2, retry: Retry{Attempts: 2}, attempts: 2},
+		{name: "not retryable", status: http.StatusForbidden, fails: 1, retry: Retry{Attempts: 3}, attempts: 1},
+		{name: "disabled", status: http.StatusInternalServerError, fails: 1, attempts: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := makeData(1000)
+			server := httptest.NewServer(&contentServer{content: content, hook: failFirst(tt.fails, 500, tt.status)})
+			defer server.Close()
+
+			var logs bytes.Buffer
+			c, err := NewClientWithOptions(nil,
+				WithChunkSize(100),
+				WithWorkers(4),
+				WithRetry(tt.retry.Attempts, tt.retry.Backoff),
+				WithLogger(slog.New(slog.NewTextHandler(&logs, nil))),
+			)
+			assert.NoError(t, err)
+			resp, err := c.Get(server.URL)
+			assert.NoError(t, err)
+			defer resp.Body.Close()
+
+			got, err := io.ReadAll(resp.Body)
+			if tt.attempts > 0 {
+				var chunkErr *ChunkError
+				if assert.ErrorAs(t, err, &chunkErr) {
+					assert.Equal(t, tt.status, chunkErr.StatusCode)
+					assert.Equal(t, tt.attempts, chunkErr.Attempt)
+				}
+				assert.Contains(t, logs.String(), "chonker: chunk failed")
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, content, got)
+			assert.Contains(t, logs.String(), "chonker: retrying chunk")
+		})
+	}
+}
+
+func TestDo_RetryShortChunk(t *testing.T) {
+	content := makeData(1000)
+	var mu sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		if r.Header.Get("Range") == "bytes=500-599" {
+			// Send the start of the chunk, and end the body early.
+			c := Chunk{Start: 500, Length: 100}
+			w.Header().Set("Content-Range", c.ContentRangeHeader(uint64(len(content))))
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write(content[500:550])
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	req, err := NewRequestWithOptions(context.Background(), http.MethodGet, server.URL, nil,
+		WithChunkSize(100), WithWorkers(4), WithRetry(2, 0))
+	assert.NoError(t, err)
+	resp, err := Do(nil, req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	got, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, content, got)
+
+	// Only the rest of the chunk is fetched again.
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Contains(t, ranges, "bytes=550-599")
+}
+
+func TestWithRequestOptions(t *testing.T) {
+	content := makeData(1000)
+	var mu sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		if r.URL.Path == "/norange" {
+			w.Write(content)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	c, err := NewClientWithOptions(nil, WithChunkSize(100))
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		path   string
+		opts   []Option
+		ranges int
+	}{
+		{name: "defaults", ranges: 10},
+		{name: "chunk size", opts: []Option{WithChunkSize(500)}, ranges: 2},
+		{name: "bypass", opts: []Option{WithBypass()}, ranges: 1},
+		{name: "opportunistic", path: "/norange", opts: []Option{WithOpportunisticRange()}, ranges: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			ranges = nil
+			mu.Unlock()
+
+			ctx := WithRequestOptions(context.Background(), tt.opts...)
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+tt.path, nil)
+			assert.NoError(t, err)
+			resp, err := c.Do(req)
+			assert.NoError(t, err)
+			defer resp.Body.Close()
+			got, err := io.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, content, got)
+
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Len(t, ranges, tt.ranges)
+			if tt.name == "bypass" {
+				assert.Equal(t, []string{""}, ranges)
+			}
+		})
+	}
+
+	ctx := WithRequestOptions(context.Background(), WithWorkers(8))
+	ctx = WithRequestOptions(ctx, WithWorkers(0))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	assert.NoError(t, err)
+	_, err = c.Do(req)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+}
+
+// countingTransport counts the requests it sends.
+type countingTransport struct {
+	n atomic.Int64
+}
+
+func (t *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.n.Add(1)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestNewClientWithOptions_KeepsPolicies(t *testing.T) {
+	content := makeData(1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusFound)
+			return
+		}
+		// Each chunk is fast, but the whole download is slower than the timeout.
+		time.Sleep(20 * time.Millisecond)
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "1"})
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	jar, err := cookiejar.New(nil)
+	assert.NoError(t, err)
+	transport := &countingTransport{}
+	var redirects int
+	c, err := NewClientWithOptions(&http.Client{
+		Transport: transport,
+		Jar:       jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			redirects++
+			return nil
+		},
+		Timeout: 100 * time.Millisecond,
+	}, WithChunkSize(100), WithWorkers(1))
+	assert.NoError(t, err)
+	assert.Nil(t, c.Jar)
+	assert.Zero(t, c.Timeout)
+
+	resp, err := c.Get(server.URL + "/new")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	got, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, content, got)
+	assert.Equal(t, int64(10), transport.n.Load())
+	u, _ := url.Parse(server.URL)
+	assert.Len(t, jar.Cookies(u), 1)
+
+	resp, err = c.Get(server.URL + "/old")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	got, err = io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, content, got)
+	assert.Positive(t, redirects)
+}
+
+func TestNewClientWithOptions_Cookies(t *testing.T) {
+	content := makeData(1000)
+	handler := &contentServer{content: content, hook: func(w http.ResponseWriter, r *http.Request) bool {
+		switch {
+		case r.URL.Path == "/login":
+			// The cookie is set on a redirect hop, and required at its target.
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "1"})
+			http.Redirect(w, r, "/file", http.StatusFound)
+		case r.Header.Get("Cookie") != "session=1":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			return false
+		}
+		return true
+	}}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	for _, ctx := range []context.Context{
+		context.Background(),
+		WithRequestOptions(context.Background(), WithBypass()),
+	} {
+		jar, err := cookiejar.New(nil)
+		assert.NoError(t, err)
+		c, err := NewClientWithOptions(&http.Client{Jar: jar}, WithChunkSize(100), WithWorkers(4))
+		assert.NoError(t, err)
+		handler.reset()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/login", nil)
+		assert.NoError(t, err)
+		resp, err := c.Do(req)
+		assert.NoError(t, err)
+		got, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.NoError(t, err)
+		assert.Equal(t, content, got)
+		// Redirects are followed once, and cookies are sent once.
+		assert.Len(t, pathRequests(handler, "/login"), 1)
+		for _, r := range pathRequests(handler, "/file") {
+			assert.Equal(t, "session=1", r.Header.Get("Cookie"))
+		}
+	}
+}
+
+func TestNewClientWithOptions_Timeout(t *testing.T) {
+	content := makeData(1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/old":
+			http.Redirect(w, r, "/slow", http.StatusFound)
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+		case "/whole":
+			// Ignore ranges, and send the content slower than the timeout.
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			for i := 0; i < len(content); i += 250 {
+				_, _ = w.Write(content[i : i+250])
+				w.(http.Flusher).Flush()
+				time.Sleep(40 * time.Millisecond)
+			}
+		}
+	}))
+	defer server.Close()
+
+	c, err := NewClientWithOptions(&http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		Timeout:       100 * time.Millisecond,
+	}, WithChunkSize(100), WithWorkers(2), WithOpportunisticRange())
+	assert.NoError(t, err)
+
+	t.Run("bypassed", func(t *testing.T) {
+		ctx := WithRequestOptions(context.Background(), WithBypass())
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/slow", nil)
+		assert.NoError(t, err)
+		_, err = c.Do(req)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/old", nil)
+		assert.NoError(t, err)
+		resp, err := c.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusFound, resp.StatusCode)
+	})
+
+	t.Run("whole content", func(t *testing.T) {
+		for _, ctx := range []context.Context{
+			context.Background(),
+			WithRequestOptions(context.Background(), WithMinSize(10000)),
+		} {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/whole", nil)
+			assert.NoError(t, err)
+			resp, err := c.Do(req)
+			assert.NoError(t, err)
+			got, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.NoError(t, err)
+			assert.Equal(t, content, got)
+		}
+	})
+
+	t.Run("whole content with Do", func(t *testing.T) {
+		// Called directly, Do keeps the Timeout of the client for whole content.
+		req, err := NewRequest(http.MethodGet, server.URL+"/whole", nil, 100, 2)
+		assert.NoError(t, err)
+		resp, err := Do(&http.Client{Timeout: 100 * time.Millisecond}, req.WithOpportunisticRange())
+		if err == nil {
+			_, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		assert.ErrorContains(t, err, "Client.Timeout")
+	})
+}
@@ -0,0 +1,152 @@
+package chonker
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ChunkPlanner decides how content is divided into chunks.
+// Chunks are planned one at a time, from the start of the requested range,
+// so that content of unknown size can be planned too.
+// FixedChunkPlanner and PartChunkPlanner are the available planners.
+type ChunkPlanner interface {
+	// NextChunk returns the chunk that starts at offset and ends at or before end.
+	// offset is less than end. The chunk must be at least one byte long.
+	NextChunk(offset, end uint64) Chunk
+}
+
+// FixedChunkPlanner plans chunks of a fixed size.
+// Chunks are aligned to multiples of the size, as with Chunks.
+// It is the planner used by requests unless another is configured.
+type FixedChunkPlanner uint64
+
+// NextChunk implements ChunkPlanner.
+func (p FixedChunkPlanner) NextChunk(offset, end uint64) Chunk {
+	size := uint64(p)
+	return Chunk{
+		Start:  offset,
+		Length: min(size-offset%size, end-offset),
+	}
+}
+
+// PartChunkPlanner plans chunks aligned to the parts that content was
+// uploaded in, such as the parts of an S3 multipart upload.
+// CDNs and object stores serve and cache ranges that match parts best.
+type PartChunkPlanner struct {
+	// ends holds the offsets at which the listed parts end.
+	ends []uint64
+	// last is the size of the last listed part.
+	last         uint64
+	maxChunkSize uint64
+}
+
+// NewPartChunkPlanner returns a planner for content uploaded in parts of
+// the given sizes, in order.
+// If the content extends past the listed parts, the size of the last part
+// repeats, so a single size plans content uploaded in parts of equal size.
+// Parts longer than maxChunkSize are split into chunks of that size,
+// aligned to the start of the part. If maxChunkSize is zero, chunks are whole parts.
+// If no parts are listed, or any part is empty, ErrInvalidArgument is returned.
+func NewPartChunkPlanner(parts []uint64, maxChunkSize uint64) (*PartChunkPlanner, error) {
+	if len(parts) == 0 {
+		return nil, ErrInvalidArgument
+	}
+	p := &PartChunkPlanner{
+		ends:         make([]uint64, len(parts)),
+		last:         parts[len(parts)-1],
+		maxChunkSize: maxChunkSize,
+	}
+	var end uint64
+	for i, size := range parts {
+		if size == 0 {
+			return nil, ErrInvalidArgument
+		}
+		end += size
+		p.ends[i] = end
+	}
+	return p, nil
+}
+
+// NextChunk implements ChunkPlanner.
+func (p *PartChunkPlanner) NextChunk(offset, end uint64) Chunk {
+	// Find the part that offset falls in.
+	var partStart, partEnd uint64
+	listed := p.ends[len(p.ends)-1]
+	if i := sort.Search(len(p.ends), func(i int) bool { return p.ends[i] > offset }); i < len(p.ends) {
+		partEnd = p.ends[i]
+		if i > 0 {
+			partStart = p.ends[i-1]
+		}
+	} else {
+		partStart = offset - (offset-listed)%p.last
+		partEnd = partStart + p.last
+		if partEnd < partStart {
+			partEnd = math.MaxUint64
+		}
+	}
+
+	if p.maxChunkSize != 0 {
+		chunkStart := partStart + (offset-partStart)/p.maxChunkSize*p.maxChunkSize
+		if chunkEnd := chunkStart + p.maxChunkSize; chunkEnd > chunkStart && chunkEnd < partEnd {
+			partEnd = chunkEnd
+		}
+	}
+	return Chunk{Start: offset, Length: min(partEnd, end) - offset}
+}
+
+// MultipartPartCount returns the number of parts content was uploaded in,
+// as encoded in the ETag of objects uploaded with an S3 multipart upload,
+// like "d41d8cd98f00b204e9800998ecf8427e-38".
+// It returns zero if etag is not such an ETag.
+func MultipartPartCount(etag string) int {
+	etag = strings.Trim(strings.TrimPrefix(etag, "W/"), `"`)
+	_, count, ok := strings.Cut(etag, "-")
+	if !ok {
+		return 0
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 1 {
+		return 0
+	}
+	return n
+}
+
+// PlanChunks divides the range [offset, size) into chunks planned by p.
+func PlanChunks(p ChunkPlanner, offset, size uint64) []Chunk {
+	plan := &chunkPlan{planner: p, next: offset, end: size}
+	chunks := make([]Chunk, 0)
+	for c, ok := plan.Next(); ok; c, ok = plan.Next() {
+		chunks = append(chunks, c)
+	}
+	return chunks
+}
+
+// chunkPlan lazily divides the range [next, end) into chunks planned by planner.
+type chunkPlan struct {
+	planner ChunkPlanner
+	next    uint64
+	end     uint64
+}
+
+// peek returns the next chunk without consuming it.
+// The second return value is false if there are no more chunks.
+func (p *chunkPlan) peek() (Chunk, bool) {
+	if p.next >= p.end {
+		return Chunk{}, false
+	}
+	// Guard against planners that return chunks out of place.
+	c := p.planner.NextChunk(p.next, p.end)
+	c.Start = p.next
+	c.Length = max(1, min(c.Length, p.end-p.next))
+	return c, true
+}
+
+// Next returns the next chunk.
+// The second return value is false if there are no more chunks.
+func (p *chunkPlan) Next() (Chunk, bool) {
+	c, ok := p.peek()
+	p.next += c.Length
+	return c, ok
+}
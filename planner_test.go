@@ -0,0 +1,146 @@
+package chonker
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFixedChunkPlanner(t *testing.T) {
+	for _, tt := range []struct {
+		chunkSize, offset, size uint64
+	}{
+		{10, 0, 0},
+		{10, 0, 87},
+		{75, 0, 100},
+		{10, 12, 50},
+		{10000, 57, 100},
+	} {
+		assert.Equal(t, Chunks(tt.chunkSize, tt.offset, tt.size),
+			PlanChunks(FixedChunkPlanner(tt.chunkSize), tt.offset, tt.size))
+	}
+}
+
+func TestPartChunkPlanner(t *testing.T) {
+	tests := []struct {
+		name         string
+		parts        []uint64
+		maxChunkSize uint64
+		offset       uint64
+		size         uint64
+		want         []Chunk
+	}{
+		{
+			name:  "uniform parts",
+			parts: []uint64{30},
+			size:  100,
+			want:  []Chunk{{0, 30}, {30, 30}, {60, 30}, {90, 10}},
+		},
+		{
+			name:   "uniform parts from offset",
+			parts:  []uint64{30},
+			offset: 45,
+			size:   100,
+			want:   []Chunk{{45, 15}, {60, 30}, {90, 10}},
+		},
+		{
+			name:  "listed parts",
+			parts: []uint64{10, 40, 5},
+			size:  70,
+			want:  []Chunk{{0, 10}, {10, 40}, {50, 5}, {55, 5}, {60, 5}, {65, 5}},
+		},
+		{
+			name:         "split parts",
+			parts:        []uint64{10, 40, 5},
+			maxChunkSize: 15,
+			offset:       5,
+			size:         55,
+			want:         []Chunk{{5, 5}, {10, 15}, {25, 15}, {40, 10}, {50, 5}},
+		},
+		{
+			name:   "offset in listed part",
+			parts:  []uint64{10, 40},
+			offset: 20,
+			size:   60,
+			want:   []Chunk{{20, 30}, {50, 10}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewPartChunkPlanner(tt.parts, tt.maxChunkSize)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, PlanChunks(p, tt.offset, tt.size))
+		})
+	}
+
+	_, err := NewPartChunkPlanner(nil, 0)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+	_, err = NewPartChunkPlanner([]uint64{10, 0}, 0)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+}
+
+func TestMultipartPartCount(t *testing.T) {
+	assert.Equal(t, 38, MultipartPartCount(`"d41d8cd98f00b204e9800998ecf8427e-38"`))
+	assert.Equal(t, 2, MultipartPartCount(`W/"abc-2"`))
+	assert.Equal(t, 0, MultipartPartCount(`"d41d8cd98f00b204e9800998ecf8427e"`))
+	assert.Equal(t, 0, MultipartPartCount(`"abc-x"`))
+	assert.Equal(t, 0, MultipartPartCount(""))
+}
+
+func TestDo_ChunkPlanner(t *testing.T) {
+	content := makeData(100)
+
+	var mu sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			ranges = append(ranges, r.Header.Get("Range"))
+			mu.Unlock()
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+		}),
+	)
+	defer server.Close()
+
+	planner, err := NewPartChunkPlanner([]uint64{40}, 0)
+	assert.NoError(t, err)
+	req, err := NewRequest(http.MethodGet, server.URL, nil, 10, 2)
+	assert.NoError(t, err)
+	resp, err := Do(nil, req.WithChunkPlanner(planner))
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	got, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, content, got)
+	// The probe is the first part.
+	assert.Equal(t, "bytes=0-39", ranges[0])
+	assert.ElementsMatch(t, []string{"bytes=0-39", "bytes=40-79", "bytes=80-99"}, ranges)
+}
+
+// emptyChunkPlanner plans chunks without any bytes at the wrong offset.
+type emptyChunkPlanner struct{}
+
+func (emptyChunkPlanner) NextChunk(_, _ uint64) Chunk {
+	return Chunk{Start: 7}
+}
+
+func TestProbeChunk_EmptyChunkPlanner(t *testing.T) {
+	// The probe is at least a byte long, and starts where it was asked to.
+	for rangeVal, want := range map[string]Chunk{
+		"":           {Start: 0, Length: 1},
+		"bytes=3-9":  {Start: 3, Length: 1},
+		"bytes=-100": {Start: 0, Length: 1},
+	} {
+		got, err := probeChunk(rangeVal, emptyChunkPlanner{})
+		assert.NoError(t, err)
+		assert.Equal(t, want, got, rangeVal)
+	}
+}
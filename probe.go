@@ -0,0 +1,141 @@
+package chonker
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// ProbeStrategy is the way Do finds out whether a server supports range requests,
+// and the size of the requested content.
+type ProbeStrategy int
+
+const (
+	// ProbeGet probes the server with a ranged GET request for the first chunk.
+	// The probe response body is used as the first chunk of the response.
+	// This is the default.
+	ProbeGet ProbeStrategy = iota
+	// ProbeHead probes the server with a HEAD request.
+	// If the server rejects the HEAD request, or its response lacks the
+	// Accept-Ranges or Content-Length headers, Do falls back to ProbeGet.
+	ProbeHead
+)
+
+// MarshalText returns "get" or "head".
+func (s ProbeStrategy) MarshalText() ([]byte, error) {
+	switch s {
+	case ProbeGet:
+		return []byte("get"), nil
+	case ProbeHead:
+		return []byte("head"), nil
+	default:
+		return nil, fmt.Errorf("chonker: unknown probe strategy %d", s)
+	}
+}
+
+// UnmarshalText parses "get" or "head".
+func (s *ProbeStrategy) UnmarshalText(text []byte) error {
+	switch strings.ToLower(string(text)) {
+	case "get":
+		*s = ProbeGet
+	case "head":
+		*s = ProbeHead
+	default:
+		return fmt.Errorf("chonker: unknown probe strategy %q", text)
+	}
+	return nil
+}
+
+// probeHead probes the server with a HEAD request.
+// It returns the probe response and the size of the content.
+// If the response is not enough to plan chunks, the third return value is false.
+func probeHead(c *http.Client, r *Request) (*http.Response, uint64, bool, error) {
+	probeReq := r.subRequest(r.Context(), http.MethodHead)
+	probeReq.Header.Del(headerNameRange)
+	probeResp, err := c.Do(probeReq)
+	if err != nil {
+		return nil, 0, false, &ProbeError{URL: r.URL.String(), Err: err}
+	}
+
+	if probeResp.StatusCode != http.StatusOK || !acceptsByteRanges(probeResp.Header) {
+		probeResp.Body.Close()
+		return nil, 0, false, nil
+	}
+	if err := r.checkEncoding(probeResp.Header); err != nil {
+		probeResp.Body.Close()
+		return nil, 0, false, newProbeError(r, probeResp, err)
+	}
+	size, err := strconv.ParseUint(probeResp.Header.Get(headerNameContentLength), 10, 64)
+	if err != nil || size == 0 {
+		probeResp.Body.Close()
+		return nil, 0, false, nil
+	}
+
+	return probeResp, size, true, nil
+}
+
+// newProbeError returns a ProbeError for a failed probe of r.
+func newProbeError(r *Request, probeResp *http.Response, err error) *ProbeError {
+	return &ProbeError{
+		URL:        r.URL.String(),
+		StatusCode: probeResp.StatusCode,
+		Header:     probeResp.Header,
+		Err:        err,
+	}
+}
+
+// acceptsByteRanges reports whether the Accept-Ranges header in h includes bytes.
+func acceptsByteRanges(h http.Header) bool {
+	for _, v := range h.Values(headerNameAcceptRanges) {
+		for _, unit := range strings.Split(v, ",") {
+			if textproto.TrimString(unit) == "bytes" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// strongValidator returns the ETag in h if it is a strong validator,
+// and an empty string otherwise.
+// Only strong validators can be used in If-Range headers.
+func strongValidator(h http.Header) string {
+	etag := h.Get(headerNameETag)
+	if strings.HasPrefix(etag, "W/") {
+		return ""
+	}
+	return etag
+}
+
+// probeChunk returns the chunk a probe request for the range in rangeVal should fetch.
+// That is the first chunk of the requested range, or of the whole content if rangeVal is empty.
+// Suffix ranges can't be located before the content size is known, so they are probed
+// with a single byte from the start of the content.
+// The chunk goes through the same checks as every other chunk of the plan.
+func probeChunk(rangeVal string, planner ChunkPlanner) (Chunk, error) {
+	requested := Chunk{Start: 0, Length: math.MaxInt64}
+	if rangeVal != "" {
+		// Parse the range against the largest possible size to find out where it starts.
+		cs, err := ParseRange(rangeVal, math.MaxInt64)
+		if err != nil {
+			return Chunk{}, fmt.Errorf("chonker: error parsing requested range %s: %w", rangeVal, err)
+		} else if len(cs) > 1 {
+			return Chunk{}, ErrMultipleRangesUnsupported
+		} else if len(cs) == 0 || isSuffixRange(rangeVal) {
+			return Chunk{0, 1}, nil
+		}
+		requested = cs[0]
+	}
+
+	first, _ := (&chunkPlan{planner: planner, next: requested.Start, end: requested.Start + requested.Length}).peek()
+	return first, nil
+}
+
+// isSuffixRange reports whether the Range header value rangeVal is a suffix range,
+// which counts back from the end of the content.
+func isSuffixRange(rangeVal string) bool {
+	return strings.HasPrefix(textproto.TrimString(strings.TrimPrefix(rangeVal, "bytes=")), "-")
+}
@@ -0,0 +1,226 @@
+package chonker
+
+import (
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultProbeCacheTTL is the longest time probe results are cached for by
+// the client returned from New, NewClient and NewRoundTripper.
+const DefaultProbeCacheTTL = time.Minute
+
+const headerNameCacheControl = "Cache-Control"
+const headerNameVary = "Vary"
+
+// ProbeResult is what a probe found out about the content at a URL.
+type ProbeResult struct {
+	// Size is the size of the content.
+	Size uint64
+	// Validator is the strong ETag of the content, if any.
+	Validator string
+	// RangeSupported reports whether the server supports range requests.
+	RangeSupported bool
+	// Header is the header of the probe response.
+	Header http.Header
+	// Vary holds the request headers named in the Vary header of the probe response.
+	// A cached result is only used for requests with the same values for them.
+	Vary http.Header
+	// Expires is the time after which the result is stale.
+	// A zero value means the cache decides.
+	Expires time.Time
+}
+
+// ProbeCache stores probe results so that repeated requests for the same URL
+// skip probing the server.
+// Keys are URLs, or origins for results that apply to a whole host.
+// Implementations must be safe for concurrent use.
+type ProbeCache interface {
+	// Get returns the result stored for key, if it hasn't expired.
+	Get(key string) (*ProbeResult, bool)
+	// Set stores p for key.
+	Set(key string, p *ProbeResult)
+	// Delete removes the result stored for key.
+	Delete(key string)
+}
+
+// WithProbeCache configures r to look up and store probe results in pc.
+// Probe results are cached as long as the Cache-Control header of the probe
+// response allows.
+// URLs that do not support range requests are remembered too, as are whole
+// hosts that answer with "Accept-Ranges: none", so opportunistic requests to
+// them go straight to a plain GET request.
+func (r *Request) WithProbeCache(pc ProbeCache) *Request {
+	r.probeCache = pc
+	return r
+}
+
+// NewProbeCache returns an in-memory ProbeCache.
+// Results are kept for at most ttl.
+func NewProbeCache(ttl time.Duration) ProbeCache {
+	return &memoryProbeCache{
+		ttl:     ttl,
+		results: make(map[string]*ProbeResult),
+	}
+}
+
+type memoryProbeCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	results map[string]*ProbeResult
+}
+
+func (m *memoryProbeCache) Get(key string) (*ProbeResult, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.results[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(p.Expires) {
+		delete(m.results, key)
+		return nil, false
+	}
+	return p, true
+}
+
+func (m *memoryProbeCache) Set(key string, p *ProbeResult) {
+	now := time.Now()
+	if maxExpires := now.Add(m.ttl); p.Expires.IsZero() || p.Expires.After(maxExpires) {
+		pp := *p
+		pp.Expires = maxExpires
+		p = &pp
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Sweep expired results every once in a while so the cache doesn't grow forever.
+	if len(m.results) >= 1024 {
+		for k, v := range m.results {
+			if now.After(v.Expires) {
+				delete(m.results, k)
+			}
+		}
+	}
+	m.results[key] = p
+}
+
+func (m *memoryProbeCache) Delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.results, key)
+}
+
+// probeCacheKey returns the key results for u are cached under.
+func probeCacheKey(u *url.URL) string {
+	return u.String()
+}
+
+// originProbeCacheKey returns the key results for the host of u are cached under.
+func originProbeCacheKey(u *url.URL) string {
+	return u.Scheme + "://" + u.Host
+}
+
+// rangeUnsupported reports whether the probe cache of r remembers that the
+// server of r doesn't support range requests for its URL, or for its host.
+func (r *Request) rangeUnsupported() bool {
+	for _, key := range []string{probeCacheKey(r.URL), originProbeCacheKey(r.URL)} {
+		if p, ok := r.probeCache.Get(key); ok && !p.RangeSupported {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheRangeUnsupported remembers that the server of r answered a range
+// request with the whole content, given the header h of its response.
+// Only servers that send "Accept-Ranges: none" are remembered for their
+// whole host, since other URLs of the host, like static files behind the same
+// CDN as a dynamic endpoint, might well support range requests.
+func (r *Request) cacheRangeUnsupported(h http.Header) {
+	if r.probeCache == nil {
+		return
+	}
+	r.probeCache.Set(probeCacheKey(r.URL), &ProbeResult{RangeSupported: false})
+	if textproto.TrimString(h.Get(headerNameAcceptRanges)) == "none" {
+		r.probeCache.Set(originProbeCacheKey(r.URL), &ProbeResult{RangeSupported: false})
+	}
+}
+
+// newProbeResult returns the result of a successful probe of r.
+// The second return value is false if the Cache-Control or Vary headers of
+// probeResp forbid caching it.
+func newProbeResult(r *http.Request, probeResp *http.Response, size uint64) (*ProbeResult, bool) {
+	expires, ok := cacheExpiry(probeResp.Header)
+	if !ok {
+		return nil, false
+	}
+
+	p := &ProbeResult{
+		Size:           size,
+		Validator:      strongValidator(probeResp.Header),
+		RangeSupported: true,
+		Header:         probeResp.Header.Clone(),
+		Vary:           make(http.Header),
+		Expires:        expires,
+	}
+	p.Header.Del(headerNameContentRange)
+	p.Header.Del(headerNameContentLength)
+
+	for _, v := range probeResp.Header.Values(headerNameVary) {
+		for _, name := range strings.Split(v, ",") {
+			name = textproto.TrimString(name)
+			if name == "*" {
+				return nil, false
+			}
+			if name != "" {
+				p.Vary[http.CanonicalHeaderKey(name)] = r.Header.Values(name)
+			}
+		}
+	}
+
+	return p, true
+}
+
+// matches reports whether p applies to r according to the Vary header it was stored with.
+func (p *ProbeResult) matches(r *http.Request) bool {
+	for name, values := range p.Vary {
+		if strings.Join(values, ",") != strings.Join(r.Header.Values(name), ",") {
+			return false
+		}
+	}
+	return true
+}
+
+// cacheExpiry returns the expiry time set by the Cache-Control header in h.
+// A zero time means the header sets none.
+// The second return value is false if the header forbids caching.
+func cacheExpiry(h http.Header) (time.Time, bool) {
+	var expires time.Time
+	for _, v := range h.Values(headerNameCacheControl) {
+		for _, directive := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(textproto.TrimString(directive), "=")
+			switch strings.ToLower(name) {
+			case "no-store", "no-cache":
+				return time.Time{}, false
+			case "max-age":
+				seconds, err := strconv.ParseUint(strings.Trim(value, `"`), 10, 32)
+				if err != nil {
+					return time.Time{}, false
+				}
+				if seconds == 0 {
+					return time.Time{}, false
+				}
+				expires = time.Now().Add(time.Duration(seconds) * time.Second)
+			}
+		}
+	}
+	return expires, true
+}
@@ -0,0 +1,127 @@
+package chonker
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// RedirectResolution is the way chunk requests deal with redirects of the
+// requested URL, like those of presigned URLs or of release downloads to CDNs.
+type RedirectResolution int
+
+const (
+	// ReresolveRedirects sends chunk requests straight to the URL the probe
+	// was redirected to, skipping the redirects. If that URL answers a chunk
+	// request with 403 Forbidden or 410 Gone, for instance because it expired,
+	// the chunk is requested again from the requested URL, and the URL it is
+	// redirected to is used for the remaining chunks. This is the default.
+	ReresolveRedirects RedirectResolution = iota
+	// ResolveRedirects is like ReresolveRedirects, but keeps sending chunk
+	// requests to the URL the probe was redirected to, even once it's rejected.
+	ResolveRedirects
+	// FollowRedirects sends chunk requests to the requested URL, so that each
+	// chunk follows the redirects.
+	FollowRedirects
+)
+
+// MarshalText returns "reresolve", "resolve", or "follow".
+func (m RedirectResolution) MarshalText() ([]byte, error) {
+	switch m {
+	case ReresolveRedirects:
+		return []byte("reresolve"), nil
+	case ResolveRedirects:
+		return []byte("resolve"), nil
+	case FollowRedirects:
+		return []byte("follow"), nil
+	default:
+		return nil, fmt.Errorf("chonker: unknown redirect resolution %d", m)
+	}
+}
+
+// UnmarshalText parses "reresolve", "resolve", or "follow".
+func (m *RedirectResolution) UnmarshalText(text []byte) error {
+	switch strings.ToLower(string(text)) {
+	case "reresolve":
+		*m = ReresolveRedirects
+	case "resolve":
+		*m = ResolveRedirects
+	case "follow":
+		*m = FollowRedirects
+	default:
+		return fmt.Errorf("chonker: unknown redirect resolution %q", text)
+	}
+	return nil
+}
+
+// WithRedirectResolution configures how the chunk requests of r deal with
+// redirects. See RedirectResolution.
+func (r *Request) WithRedirectResolution(m RedirectResolution) *Request {
+	r.redirects = m
+	return r
+}
+
+// resolve makes chunks skip the redirects that resp followed, if any,
+// and if the redirect resolution of the request allows it.
+func (r *remoteFileReader) resolve(resp *http.Response) {
+	if r.request.redirects == FollowRedirects || resp == nil || resp.Request == nil {
+		return
+	}
+	hops := redirectHops(resp)
+	if hops == 0 {
+		return
+	}
+	r.target.Store(&resolvedURL{URL: resp.Request.URL, hops: hops})
+}
+
+// resolvedURL is the URL a request was redirected to,
+// after the given number of redirects.
+type resolvedURL struct {
+	*url.URL
+	hops int
+}
+
+// redirectHops returns the number of redirects followed to get resp.
+func redirectHops(resp *http.Response) int {
+	var hops int
+	for req := resp.Request; req != nil && req.Response != nil; req = req.Response.Request {
+		hops++
+	}
+	return hops
+}
+
+// shouldReresolve reports whether a chunk answered with resp should be
+// requested again from the requested URL, to find a fresh URL to redirect to.
+// URLs from the URL refresher aren't redirect targets, and are never given up
+// for the requested URL, which they replaced.
+func (r *remoteFileReader) shouldReresolve(resp *http.Response) bool {
+	if r.request.redirects != ReresolveRedirects || resp == nil {
+		return false
+	}
+	if target := r.target.Load(); target == nil || target.hops == 0 {
+		return false
+	}
+	return resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusGone
+}
+
+// redirectRequest points req, a request for the requested URL, to the URL u it
+// redirects to. Like the redirects followed by http.Client, it drops sensitive
+// headers unless u is on the same host as req, or one of its subdomains.
+func redirectRequest(req *http.Request, u *url.URL) {
+	if u.Host != req.URL.Host {
+		req.Host = ""
+	}
+	if !isDomainOrSubdomain(u.Hostname(), req.URL.Hostname()) {
+		for _, h := range []string{"Authorization", "Proxy-Authorization", "Www-Authenticate", "Cookie", "Cookie2"} {
+			req.Header.Del(h)
+		}
+	}
+	req.URL = u
+}
+
+// isDomainOrSubdomain reports whether sub is parent or one of its subdomains.
+func isDomainOrSubdomain(sub, parent string) bool {
+	sub, parent = strings.ToLower(sub), strings.ToLower(parent)
+	return sub == parent || strings.HasSuffix(sub, "."+parent)
+}
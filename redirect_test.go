@@ -0,0 +1,156 @@
+package chonker
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// redirectingServer returns a server that redirects /download to
+// /content?v=<version>, and serves content there. Chunks of stale versions
+// are answered with 403 Forbidden, like expired presigned URLs.
+// Calling expire moves on to the next version.
+func redirectingServer(content []byte) (handler *contentServer, expire func()) {
+	var version atomic.Int32
+	handler = &contentServer{content: content, hook: func(w http.ResponseWriter, r *http.Request) bool {
+		switch {
+		case r.URL.Path == "/download":
+			http.Redirect(w, r, fmt.Sprintf("/content?v=%d", version.Load()), http.StatusFound)
+		case r.URL.Query().Get("v") != strconv.Itoa(int(version.Load())):
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			return false
+		}
+		return true
+	}}
+	return handler, func() { version.Add(1) }
+}
+
+// pathRequests returns the requests s got for path.
+func pathRequests(s *contentServer, path string) []*http.Request {
+	var reqs []*http.Request
+	for _, r := range s.requested() {
+		if r.URL.Path == path {
+			reqs = append(reqs, r)
+		}
+	}
+	return reqs
+}
+
+func TestDo_RedirectResolution(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       RedirectResolution
+		downloads  int
+		redirected int
+	}{
+		{name: "resolve", mode: ResolveRedirects, downloads: 1, redirected: 9},
+		{name: "follow", mode: FollowRedirects, downloads: 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := makeData(1000)
+			handler, _ := redirectingServer(content)
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			m := getHostMetrics(server.Listener.Addr().String())
+			saved := m.requestRedirectsSavedTotal.Get()
+
+			req, err := NewRequest(http.MethodGet, server.URL+"/download", nil, 100, 4)
+			assert.NoError(t, err)
+			req.Header.Set("Authorization", "Bearer secret")
+			resp, err := Do(nil, req.WithRedirectResolution(tt.mode))
+			assert.NoError(t, err)
+			defer resp.Body.Close()
+			got, err := io.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, content, got)
+
+			assert.Len(t, pathRequests(handler, "/download"), tt.downloads)
+			contents := pathRequests(handler, "/content")
+			assert.Len(t, contents, 10)
+			assert.Equal(t, uint64(tt.redirected), m.requestRedirectsSavedTotal.Get()-saved)
+			for _, r := range contents {
+				// The redirects stay on the same host, so credentials are kept.
+				assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+			}
+		})
+	}
+}
+
+func TestDo_ReresolveRedirects(t *testing.T) {
+	content := makeData(1000)
+	handler, expire := redirectingServer(content)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	// Redirects are re-resolved by default.
+	req, err := NewRequest(http.MethodGet, server.URL+"/download", nil, 100, 1)
+	assert.NoError(t, err)
+	resp, err := Do(nil, req.WithReadAhead(100, 0))
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	// Expire the URL redirected to after the first chunk.
+	head := make([]byte, 100)
+	_, err = io.ReadFull(resp.Body, head)
+	assert.NoError(t, err)
+	expire()
+
+	rest, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, content, append(head, rest...))
+	assert.Len(t, pathRequests(handler, "/download"), 2)
+
+	// Without re-resolving, the download fails.
+	handler, expire = redirectingServer(content)
+	server2 := httptest.NewServer(handler)
+	defer server2.Close()
+	req, err = NewRequest(http.MethodGet, server2.URL+"/download", nil, 100, 1)
+	assert.NoError(t, err)
+	resp, err = Do(nil, req.WithRedirectResolution(ResolveRedirects).WithReadAhead(100, 0))
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	_, err = io.ReadFull(resp.Body, head)
+	assert.NoError(t, err)
+	expire()
+	_, err = io.ReadAll(resp.Body)
+	var chunkErr *ChunkError
+	if assert.ErrorAs(t, err, &chunkErr) {
+		assert.Equal(t, http.StatusForbidden, chunkErr.StatusCode)
+	}
+}
+
+func TestRedirectRequest(t *testing.T) {
+	tests := []struct {
+		target   string
+		wantAuth bool
+	}{
+		{"https://example.com/b", true},
+		{"https://cdn.example.com/b", true},
+		{"https://example.org/b", false},
+		{"https://notexample.com/b", false},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(http.MethodGet, "https://example.com/a", nil)
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("Cookie", "a=b")
+		target, err := url.Parse(tt.target)
+		assert.NoError(t, err)
+
+		redirectRequest(req, target)
+		assert.Equal(t, target, req.URL)
+		assert.Equal(t, tt.wantAuth, req.Header.Get("Authorization") != "", tt.target)
+		assert.Equal(t, tt.wantAuth, req.Header.Get("Cookie") != "", tt.target)
+	}
+}
@@ -0,0 +1,175 @@
+package chonker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrContentChanged is the error of a chunk whose ETag doesn't match the ETag
+// of the content the request started fetching, including chunks answered with
+// the whole of the new content because their If-Range header no longer matched.
+var ErrContentChanged = errors.New("chonker: content changed")
+
+// URLRefresher returns a fresh URL for the content at expired, a presigned URL
+// that expired or is about to, like a presigned S3 or GCS URL, or an Azure SAS URL.
+type URLRefresher func(ctx context.Context, expired *url.URL) (*url.URL, error)
+
+// urlRefreshMargin is how long before its signed expiry a URL is refreshed.
+const urlRefreshMargin = time.Minute
+
+// WithURLRefresher configures r to call refresh for a fresh URL when a chunk
+// is rejected with 401 Unauthorized or 403 Forbidden, or when the expiry
+// signed into the query of the URL is less than a minute away.
+// Remaining chunks are requested from the fresh URL, and rejected chunks are
+// requested again, once. Chunks from the fresh URL must have the same ETag.
+func (r *Request) WithURLRefresher(refresh URLRefresher) *Request {
+	r.refresher = refresh
+	return r
+}
+
+// currentURL returns the URL chunks are requested from.
+func (r *remoteFileReader) currentURL() *url.URL {
+	if target := r.target.Load(); target != nil {
+		return target.URL
+	}
+	return r.request.URL
+}
+
+// urlRefresh is a call to the URL refresher.
+type urlRefresh struct {
+	// done is closed once the call returns with err.
+	done chan struct{}
+	err  error
+}
+
+// refreshURL asks the URL refresher for a fresh URL for stale, unless the URL
+// was refreshed since. Concurrent calls share one call to the URL refresher.
+func (r *remoteFileReader) refreshURL(ctx context.Context, stale *url.URL) error {
+	r.refreshMu.Lock()
+	if r.currentURL().String() != stale.String() {
+		r.refreshMu.Unlock()
+		return nil
+	}
+	if refresh := r.refreshing; refresh != nil {
+		r.refreshMu.Unlock()
+		select {
+		case <-refresh.done:
+			return refresh.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	refresh := &urlRefresh{done: make(chan struct{})}
+	r.refreshing = refresh
+	r.refreshMu.Unlock()
+
+	fresh, err := r.request.refresher(ctx, stale)
+
+	r.refreshMu.Lock()
+	r.refreshing = nil
+	if err == nil {
+		r.target.Store(&resolvedURL{URL: fresh})
+		if expiry, ok := urlExpiry(fresh); ok && time.Until(expiry) <= urlRefreshMargin {
+			r.stuckExpiry = expiry
+		}
+	}
+	r.refreshMu.Unlock()
+	refresh.err = err
+	close(refresh.done)
+
+	if err != nil {
+		return err
+	}
+	r.request.logger().Info("chonker: refreshed URL", "url", r.request.URL.String())
+	return nil
+}
+
+// refreshIfExpiring refreshes the URL chunks are requested from if it is
+// about to expire, unless the URL refresher already returned a URL that
+// expires as soon.
+func (r *remoteFileReader) refreshIfExpiring(ctx context.Context) {
+	current := r.currentURL()
+	expiry, ok := urlExpiry(current)
+	if !ok || time.Until(expiry) > urlRefreshMargin {
+		return
+	}
+	r.refreshMu.Lock()
+	stuck := !expiry.After(r.stuckExpiry)
+	r.refreshMu.Unlock()
+	if stuck {
+		return
+	}
+	if err := r.refreshURL(ctx, current); err != nil {
+		// Chunks are refreshed again if they are rejected.
+		r.request.logger().Warn("chonker: error refreshing URL",
+			"url", r.request.URL.String(), "error", err)
+	}
+}
+
+// shouldRefresh reports whether a chunk answered with resp should be requested
+// again from a fresh URL.
+func (r *remoteFileReader) shouldRefresh(resp *http.Response) bool {
+	if r.request.refresher == nil || resp == nil {
+		return false
+	}
+	return resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden
+}
+
+// sentURL returns the URL that the request resp answers was sent to,
+// before any redirects.
+func sentURL(resp *http.Response) *url.URL {
+	req := resp.Request
+	for req.Response != nil && req.Response.Request != nil {
+		req = req.Response.Request
+	}
+	return req.URL
+}
+
+// urlExpiry returns the expiry signed into the query of u, if any.
+// It understands presigned S3 and GCS URLs, Azure SAS URLs, and the Expires
+// parameter of CloudFront signed URLs and older S3 and GCS signatures.
+func urlExpiry(u *url.URL) (time.Time, bool) {
+	q := u.Query()
+	get := func(key string) string {
+		for k, v := range q {
+			if strings.EqualFold(k, key) && len(v) > 0 {
+				return v[0]
+			}
+		}
+		return ""
+	}
+
+	for _, prefix := range []string{"X-Amz-", "X-Goog-"} {
+		date, expires := get(prefix+"Date"), get(prefix+"Expires")
+		if date == "" || expires == "" {
+			continue
+		}
+		signed, err := time.Parse("20060102T150405Z", date)
+		seconds, err2 := strconv.ParseInt(expires, 10, 64)
+		if err != nil || err2 != nil {
+			return time.Time{}, false
+		}
+		return signed.Add(time.Duration(seconds) * time.Second), true
+	}
+	if se := get("se"); se != "" && get("sig") != "" {
+		for _, layout := range []string{time.RFC3339, "2006-01-02T15:04Z", "2006-01-02"} {
+			if t, err := time.Parse(layout, se); err == nil {
+				return t, true
+			}
+		}
+		return time.Time{}, false
+	}
+	if expires := get("Expires"); expires != "" {
+		seconds, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return time.Unix(seconds, 0), true
+	}
+	return time.Time{}, false
+}
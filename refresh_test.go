@@ -0,0 +1,223 @@
+package chonker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestURLExpiry(t *testing.T) {
+	tests := []struct {
+		url  string
+		want time.Time
+		ok   bool
+	}{
+		{
+			url:  "https://bucket.s3.amazonaws.com/key?X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Date=20240102T030405Z&X-Amz-Expires=3600&X-Amz-Signature=abc",
+			want: time.Date(2024, 1, 2, 4, 4, 5, 0, time.UTC),
+			ok:   true,
+		},
+		{
+			url:  "https://storage.googleapis.com/bucket/key?X-Goog-Date=20240102T030405Z&X-Goog-Expires=60&X-Goog-Signature=abc",
+			want: time.Date(2024, 1, 2, 3, 5, 5, 0, time.UTC),
+			ok:   true,
+		},
+		{
+			url:  "https://account.blob.core.windows.net/container/blob?sv=2022-11-02&se=2024-01-02T03:04:05Z&sr=b&sp=r&sig=abc",
+			want: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			ok:   true,
+		},
+		{
+			url:  "https://d111111abcdef8.cloudfront.net/key?Expires=1704164645&Signature=abc&Key-Pair-Id=K",
+			want: time.Unix(1704164645, 0),
+			ok:   true,
+		},
+		{url: "https://example.com/file?v=1"},
+		{url: "https://example.com/file?X-Amz-Date=yesterday&X-Amz-Expires=60"},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		assert.NoError(t, err)
+		got, ok := urlExpiry(u)
+		assert.Equal(t, tt.ok, ok, tt.url)
+		assert.True(t, tt.want.Equal(got), tt.url)
+	}
+}
+
+// urlSigner signs URLs for a contentServer that only serves requests signed
+// with the current signature, like presigned URLs that expire.
+type urlSigner struct {
+	signature atomic.Int32
+	rejected  atomic.Int32
+}
+
+// hook returns a hook that rejects requests that aren't signed with the
+// current signature, and serves other, with another ETag, at /other.
+func (s *urlSigner) hook(other []byte) func(http.ResponseWriter, *http.Request) bool {
+	return func(w http.ResponseWriter, r *http.Request) bool {
+		switch {
+		case r.URL.Query().Get("sig") != strconv.Itoa(int(s.signature.Load())):
+			s.rejected.Add(1)
+			w.WriteHeader(http.StatusForbidden)
+		case r.URL.Path == "/other":
+			// Pretend that the content changed, without honouring If-Range.
+			r.Header.Del("If-Range")
+			w.Header().Set("ETag", `"other"`)
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(other))
+		default:
+			return false
+		}
+		return true
+	}
+}
+
+func (s *urlSigner) expire() {
+	s.signature.Add(1)
+}
+
+// refresher returns a URLRefresher that signs URLs for path, valid for expires.
+func (s *urlSigner) refresher(server, path string, expires time.Duration, calls *int) URLRefresher {
+	return func(context.Context, *url.URL) (*url.URL, error) {
+		*calls++
+		return url.Parse(s.url(server, path, expires))
+	}
+}
+
+func (s *urlSigner) url(server, path string, expires time.Duration) string {
+	return fmt.Sprintf("%s%s?X-Amz-Date=%s&X-Amz-Expires=%d&sig=%d", server, path,
+		time.Now().UTC().Format("20060102T150405Z"), int(expires.Seconds()), s.signature.Load())
+}
+
+func TestDo_URLRefresher(t *testing.T) {
+	tests := []struct {
+		name string
+		// expires is how long the first URL is valid for.
+		expires time.Duration
+		// expire expires the first URL after the first chunk is read.
+		expire  bool
+		path    string
+		wantErr error
+		calls   int
+	}{
+		{name: "rejected", expires: time.Hour, expire: true, path: "/file", calls: 1},
+		{name: "expiring", expires: time.Second, path: "/file", calls: 1},
+		{name: "valid", expires: time.Hour, path: "/file"},
+		{name: "content changed", expires: time.Hour, expire: true, path: "/other", wantErr: ErrContentChanged, calls: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := makeData(1000)
+			signer := &urlSigner{}
+			server := httptest.NewServer(&contentServer{content: content, etag: `"file"`, hook: signer.hook(content[1:])})
+			defer server.Close()
+
+			var calls int
+			req, err := NewRequest(http.MethodGet, signer.url(server.URL, "/file", tt.expires), nil, 100, 1)
+			assert.NoError(t, err)
+			req = req.WithURLRefresher(signer.refresher(server.URL, tt.path, time.Hour, &calls)).WithReadAhead(100, 0)
+			resp, err := Do(nil, req)
+			assert.NoError(t, err)
+			defer resp.Body.Close()
+
+			head := make([]byte, 100)
+			_, err = io.ReadFull(resp.Body, head)
+			assert.NoError(t, err)
+			if tt.expire {
+				signer.expire()
+			}
+			rest, err := io.ReadAll(resp.Body)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, content, append(head, rest...))
+			}
+			assert.Equal(t, tt.calls, calls)
+			if !tt.expire {
+				assert.Zero(t, signer.rejected.Load())
+			}
+		})
+	}
+}
+
+func TestDo_URLRefresherReresolve(t *testing.T) {
+	content := makeData(1000)
+	signer := &urlSigner{}
+	handler := &contentServer{content: content, etag: `"file"`, hook: signer.hook(nil)}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	var calls int
+	req, err := NewRequest(http.MethodGet, signer.url(server.URL, "/file", time.Hour), nil, 100, 1)
+	assert.NoError(t, err)
+	req = req.WithURLRefresher(signer.refresher(server.URL, "/file", time.Hour, &calls)).
+		WithRedirectResolution(ReresolveRedirects).
+		WithReadAhead(100, 0)
+	resp, err := Do(nil, req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	// Expire the requested URL, and then the URL it was refreshed to.
+	got := make([]byte, 200)
+	_, err = io.ReadFull(resp.Body, got[:100])
+	assert.NoError(t, err)
+	signer.expire()
+	_, err = io.ReadFull(resp.Body, got[100:])
+	assert.NoError(t, err)
+	signer.expire()
+	rest, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, content, append(got, rest...))
+	assert.Equal(t, 2, calls)
+
+	// The requested URL is only asked for the first chunks: a rejected
+	// refreshed URL is refreshed again, not given up for the expired URL.
+	var original int
+	for _, r := range handler.requested() {
+		if r.URL.Query().Get("sig") == "0" {
+			original++
+		}
+	}
+	assert.Equal(t, 2, original)
+}
+
+func TestDo_URLRefresherExpiringSoon(t *testing.T) {
+	content := makeData(1000)
+	signer := &urlSigner{}
+	server := httptest.NewServer(&contentServer{content: content, etag: `"file"`, hook: signer.hook(nil)})
+	defer server.Close()
+
+	// The refresher only hands out URLs that are about to expire too.
+	var mu sync.Mutex
+	var calls int
+	refresh := signer.refresher(server.URL, "/file", 30*time.Second, &calls)
+	req, err := NewRequest(http.MethodGet, signer.url(server.URL, "/file", time.Second), nil, 100, 4)
+	assert.NoError(t, err)
+	req = req.WithURLRefresher(func(ctx context.Context, expired *url.URL) (*url.URL, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return refresh(ctx, expired)
+	})
+	resp, err := Do(nil, req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	got, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, content, got)
+
+	// Concurrent chunks share a refresh, and a fresh URL that is about to
+	// expire isn't refreshed again for every chunk.
+	assert.Equal(t, 1, calls)
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sourcegraph/conc/stream"
@@ -15,21 +17,96 @@ const (
 	headerNameAcceptRanges  = "Accept-Ranges"
 	headerNameContentLength = "Content-Length"
 	headerNameContentRange  = "Content-Range"
+	headerNameETag          = "ETag"
+	headerNameIfRange       = "If-Range"
 	headerNameRange         = "Range"
 )
 
 var ErrRangeUnsupported = errors.New("chonker: server does not support range requests")
 
+// errEndOfContent cancels fetching chunks past the end of content of unknown size.
+var errEndOfContent = errors.New("chonker: end of content")
+
 type remoteFileReader struct {
 	*io.PipeReader
 
 	client  *http.Client
 	request *Request
+	// conns fetch chunks over connections of their own, if not nil.
+	// Otherwise, chunks are fetched with client.
+	conns *connPool
+	// validator is the strong ETag chunks must match, if any.
+	validator string
+	// sizeUnknown is true if the size of the content is unknown.
+	// Chunks are then fetched until one comes back short, or the server
+	// reports that the range is not satisfiable.
+	sizeUnknown bool
+	// size is the size of the content, if known.
+	size uint64
+
+	// target is the URL chunks are requested from instead of the requested
+	// URL, which redirects to it, if not nil.
+	target atomic.Pointer[resolvedURL]
+	// refreshMu guards refreshing and stuckExpiry.
+	refreshMu sync.Mutex
+	// refreshing is the refresh of target with the URL refresher in flight,
+	// if any, which concurrent chunks wait for instead of refreshing again.
+	refreshing *urlRefresh
+	// stuckExpiry is the expiry of the last URL from the URL refresher, if it
+	// was already about to expire when refreshed. URLs that expire no later
+	// aren't refreshed ahead of their expiry again.
+	stuckExpiry time.Time
+
+	// readPos is the offset in the content of the next byte to be read.
+	readPos atomic.Uint64
+	// advanced is signalled when the reader advances readPos.
+	advanced chan struct{}
+
+	// done is closed when all chunks have been fetched or have failed.
+	done chan struct{}
+	// err holds the errors of failed chunks once done is closed.
+	err error
+}
+
+func newRemoteFileReader(c *http.Client, r *Request, validator string) (*remoteFileReader, *io.PipeWriter) {
+	read, write := io.Pipe()
+	return &remoteFileReader{
+		PipeReader: read,
+		client:     c,
+		request:    r,
+		validator:  validator,
+		advanced:   make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}, write
 }
 
+// Read reads from the fetched chunks.
+// If fetching chunks fails, Read waits for the remaining fetches to stop
+// and returns the errors of all failed chunks.
+func (r *remoteFileReader) Read(p []byte) (int, error) {
+	n, err := r.PipeReader.Read(p)
+	if n > 0 {
+		r.readPos.Add(uint64(n))
+		select {
+		case r.advanced <- struct{}{}:
+		default:
+		}
+	}
+	if err != nil && err != io.EOF {
+		<-r.done
+		if r.err != nil {
+			err = r.err
+		}
+	}
+	return n, err
+}
+
+// fetchChunks fetches chunks concurrently and writes them to writer in order.
+// If head is not nil, its body holds the first chunk, which is not fetched again.
 func (r *remoteFileReader) fetchChunks(
 	ctx context.Context,
-	chunks []Chunk,
+	head *http.Response,
+	chunks *chunkPlan,
 	fetchers *stream.Stream,
 	writer *io.PipeWriter,
 ) {
@@ -38,50 +115,256 @@ func (r *remoteFileReader) fetchChunks(
 	m.requestsFetching.Inc()
 	defer m.requestsFetching.Dec()
 
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
 
-	context.AfterFunc(ctx, func() {
-		writer.Close()
+	stop := context.AfterFunc(ctx, func() {
+		if cause := context.Cause(ctx); cause != errEndOfContent {
+			writer.CloseWithError(cause)
+		}
 	})
 
-	defer fetchers.Wait()
+	// Once a chunk fails, no more chunks are requested, but the chunks already
+	// requested are let finish, so that all of them that fail are reported.
+	issuing, stopIssuing := context.WithCancel(ctx)
+	defer stopIssuing()
+
+	// Errors are only recorded by callbacks, which run one at a time.
+	var errs ChunkErrors
+	defer func() {
+		fetchers.Wait()
+		stop()
+		if r.conns != nil {
+			r.conns.closeIdleConnections()
+		}
+		r.err = errs.err()
+		writer.CloseWithError(r.err)
+		close(r.done)
+	}()
 
-	for _, chunk := range chunks {
-		req := r.request.Clone(ctx)
-		req.Header.Set(headerNameRange, chunk.RangeHeader())
+	for i := 0; issuing.Err() == nil; i++ {
+		chunk, ok := chunks.Next()
+		if !ok || !r.waitForReader(issuing, chunk) {
+			break
+		}
+		// The first chunk might be the body of the probe, which is not sent again.
+		var req *http.Request
+		if i > 0 || head == nil {
+			req = r.chunkRequest(ctx, chunk)
+		}
 		fetchers.Go(func() stream.Callback {
 			m.requestChunksFetchingStageDo.Inc()
 			defer m.requestChunksFetchingStageDo.Dec()
 			defer m.requestChunksTotal.Inc()
 
 			fetchStart := time.Now()
-			resp, err := r.client.Do(req) //nolint:bodyclose
+			var resp *http.Response
+			var err error
+			if req == nil {
+				resp = r.cacheResponse(head, chunk)
+			} else {
+				resp, err = r.fetchCached(req, chunk) //nolint:bodyclose
+			}
 
 			return func() {
 				m.requestChunksFetchingStageCopy.Inc()
 				defer m.requestChunksFetchingStageCopy.Dec()
 
-				if n, ok, err := copyChunk(writer, resp, err); !ok {
-					cancel()
-					if err != nil {
-						writer.CloseWithError(err)
+				if context.Cause(ctx) == errEndOfContent {
+					// An earlier chunk was the last one.
+					if resp != nil {
+						resp.Body.Close()
 					}
-				} else {
+					return
+				}
+				if len(errs) > 0 {
+					// An earlier chunk failed, and nothing more is written.
+					// Only find out whether this chunk failed too.
+					if chunkErr := r.settleChunk(chunk, req, resp, err); chunkErr != nil {
+						errs = append(errs, chunkErr)
+					}
+					return
+				}
+
+				n, ok, attempts, resp, err := r.copyChunkWithRetries(ctx, writer, chunk, resp, err)
+				if ok {
 					m.requestChunkDurationSeconds.UpdateDuration(fetchStart)
 					m.requestChunkBytes.Update(float64(n))
+					if uint64(n) < chunk.Length {
+						// Only possible if the size of the content is unknown.
+						// Stop fetching chunks past the end.
+						cancel(errEndOfContent)
+					}
+					return
+				}
+				if err == nil || ctx.Err() != nil && errors.Is(err, context.Cause(ctx)) {
+					// Fetching was cancelled, or the reader was closed.
+					cancel(nil)
+					return
 				}
+
+				errs = append(errs, r.chunkError(chunk, req, attempts, resp, err))
+				r.forgetProbe()
+				stopIssuing()
 			}
 		})
 	}
 }
 
-// copyChunk copies a chunk from the response body to the pipe writer.
-// The first return value is the number of bytes copied.
+// chunkError returns the error of chunk, which failed after attempts with resp
+// and err. req is the request for the chunk, or nil if it came with the probe.
+func (r *remoteFileReader) chunkError(chunk Chunk, req *http.Request, attempts int, resp *http.Response, err error) *ChunkError {
+	chunkURL := r.request.URL
+	if req != nil {
+		chunkURL = req.URL
+	}
+	chunkErr := &ChunkError{
+		Chunk:   chunk,
+		URL:     chunkURL.String(),
+		Attempt: attempts,
+		Err:     err,
+	}
+	if resp != nil {
+		chunkErr.StatusCode = resp.StatusCode
+		chunkErr.Header = resp.Header
+	}
+	r.request.logger().Error("chonker: chunk failed",
+		"url", chunkErr.URL, "range", chunk.RangeHeader(), "attempts", attempts, "error", err)
+	return chunkErr
+}
+
+// settleChunk returns the error of chunk, requested with req and answered with
+// resp and err after an earlier chunk failed, or nil if it didn't fail.
+// Partial responses are taken as successful without reading them, and failed
+// chunks aren't retried.
+func (r *remoteFileReader) settleChunk(chunk Chunk, req *http.Request, resp *http.Response, err error) *ChunkError {
+	if err == nil && resp.StatusCode == http.StatusPartialContent {
+		resp.Body.Close()
+		return nil
+	}
+	_, ok, err := r.copyChunk(io.Discard, chunk, resp, err)
+	if ok || err == nil {
+		return nil
+	}
+	return r.chunkError(chunk, req, 1, resp, err)
+}
+
+// chunkRequest returns the request for chunk.
+// It is sent straight to the URL the requested URL redirects to, if known.
+// If the URL is about to expire, it is refreshed first.
+func (r *remoteFileReader) chunkRequest(ctx context.Context, chunk Chunk) *http.Request {
+	if r.request.refresher != nil {
+		r.refreshIfExpiring(ctx)
+	}
+	req := r.request.subRequest(ctx, "")
+	req.Header.Set(headerNameRange, chunk.RangeHeader())
+	if r.validator != "" {
+		req.Header.Set(headerNameIfRange, r.validator)
+	}
+	if target := r.target.Load(); target != nil {
+		redirectRequest(req, target.URL)
+		getHostMetrics(r.request.URL.Host).requestRedirectsSavedTotal.Add(target.hops)
+	}
+	return req
+}
+
+// waitForReader waits until chunk is within the read-ahead window of the
+// reader, if there is one. It returns false if ctx is done first.
+func (r *remoteFileReader) waitForReader(ctx context.Context, chunk Chunk) bool {
+	window := r.request.readAhead
+	if window == 0 {
+		return true
+	}
+	for {
+		pos := r.readPos.Load()
+		if chunk.Start <= pos || chunk.Start+chunk.Length <= pos+window {
+			return true
+		}
+		select {
+		case <-r.advanced:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// isReadingAt reports whether the reader is waiting for chunk.
+func (r *remoteFileReader) isReadingAt(chunk Chunk) bool {
+	pos := r.readPos.Load()
+	return chunk.Start <= pos && pos < chunk.Start+chunk.Length
+}
+
+// do fetches a chunk with req, hedging it if configured.
+// With Hedging, any chunk is hedged once it is slower than the configured
+// percentile of chunk response times. Otherwise, in read-ahead mode, the chunk
+// the reader is waiting for is hedged.
+func (r *remoteFileReader) do(req *http.Request, chunk Chunk) (resp *http.Response, err error) {
+	m := getHostMetrics(r.request.URL.Host)
+	client := r.chunkClient()
+	primary := hedgeAttempt{client: client, req: req}
+	backup := primary
+	var delay time.Duration
+	var hedge func() bool
+	start := time.Now()
+	defer func() {
+		if err == nil {
+			m.requestChunkResponseSeconds.UpdateDuration(start)
+		}
+	}()
+
+	switch h := r.request.hedging; {
+	case h != nil:
+		d, ok := h.delay(m.requestChunkResponseSeconds)
+		if !ok {
+			return client.Do(req)
+		}
+		delay = d
+		// Hedged chunks are counted as they are reserved.
+		hedge = func() bool { return h.reserve(m) }
+		backup = h.backup(r.chunkClient(), req)
+	case r.request.readAhead != 0 && r.request.hedgeAfter != 0:
+		delay = r.request.hedgeAfter
+		hedge = func() bool {
+			if !r.isReadingAt(chunk) {
+				return false
+			}
+			m.requestChunksHedgedTotal.Inc()
+			return true
+		}
+		backup = hedgeAttempt{client: r.chunkClient(), req: req}
+	default:
+		return client.Do(req)
+	}
+
+	var hedged bool
+	resp, hedged, err = hedgedDo(primary, backup, delay, hedge)
+	if hedged {
+		r.request.logger().Debug("chonker: hedged chunk",
+			"url", req.URL.String(), "range", chunk.RangeHeader(), "delay", delay)
+	}
+	return resp, err
+}
+
+// forgetProbe removes the cached probe result for the request, if any.
+// A failed chunk might mean that the content has changed since it was probed.
+func (r *remoteFileReader) forgetProbe() {
+	if r.request.probeCache != nil {
+		r.request.probeCache.Delete(probeCacheKey(r.request.URL))
+	}
+}
+
+// copyChunk copies chunk from the response body to the pipe writer.
+// The first return value is the number of bytes copied,
+// which is only known on success or if copying the body fails midway.
 // If the second return value is true, other copying goroutines can continue.
 // If false, all copying goroutines should stop.
 // The third return value is the error, if any.
-func copyChunk(w io.Writer, resp *http.Response, err error) (int64, bool, error) {
+func (r *remoteFileReader) copyChunk(
+	w io.Writer,
+	chunk Chunk,
+	resp *http.Response,
+	err error,
+) (int64, bool, error) {
 	if err != nil {
 		if errors.Is(err, context.Canceled) {
 			err = nil
@@ -91,17 +374,68 @@ func copyChunk(w io.Writer, resp *http.Response, err error) (int64, bool, error)
 
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusPartialContent {
-		return 0, false, fmt.Errorf("%w fetching range %s, got status %s",
-			ErrRangeUnsupported, resp.Request.Header.Get(headerNameRange), resp.Status)
+	switch {
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && r.sizeUnknown:
+		// The chunk starts past the end of the content.
+		return 0, true, nil
+	case resp.StatusCode == http.StatusOK && r.validator != "" && resp.Header.Get(headerNameETag) != r.validator:
+		// The If-Range header of the chunk request no longer matches,
+		// so the server sent the whole of the new content.
+		return 0, false, fmt.Errorf("%w, got ETag %s", ErrContentChanged, resp.Header.Get(headerNameETag))
+	case resp.StatusCode == http.StatusOK && r.request.recoverRange:
+		// The server ignored the Range header and sent the whole content.
+		// Skip to the start of the chunk, which can't be found in encoded content.
+		if err := r.request.checkEncoding(resp.Header); err != nil {
+			return 0, false, err
+		}
+		getHostMetrics(r.request.URL.Host).requestChunksRangeIgnoredTotal.Inc()
+		if _, err := io.CopyN(io.Discard, resp.Body, int64(chunk.Start)); err != nil {
+			return 0, false, fmt.Errorf("chonker: error skipping to the start of the range: %w", err)
+		}
+	case resp.StatusCode != http.StatusPartialContent:
+		return 0, false, fmt.Errorf("%w, got status %s", ErrRangeUnsupported, resp.Status)
+	default:
+		if err := r.request.checkEncoding(resp.Header); err != nil {
+			return 0, false, err
+		}
+		if etag := resp.Header.Get(headerNameETag); r.validator != "" && etag != "" && etag != r.validator {
+			return 0, false, fmt.Errorf("%w, got ETag %s", ErrContentChanged, etag)
+		}
+		crHeader := resp.Header.Get(headerNameContentRange)
+		got, size, err := ParseContentRange(crHeader)
+		if err != nil {
+			return 0, false, fmt.Errorf("chonker: error parsing Content-Range header %s: %w", crHeader, err)
+		}
+		if !r.sizeUnknown && size != UnknownSize && size != r.size {
+			// The range is of content of another size.
+			return 0, false, &RangeMismatchError{Requested: chunk, Received: *got}
+		}
+		if *got != chunk {
+			// If the size of the content is unknown, the last chunk might be short.
+			if !r.sizeUnknown || got.Start != chunk.Start || got.Length > chunk.Length {
+				return 0, false, &RangeMismatchError{Requested: chunk, Received: *got}
+			}
+			chunk = *got
+		}
 	}
 
-	n, err := io.Copy(w, resp.Body)
+	body := &io.LimitedReader{R: resp.Body, N: int64(chunk.Length)}
+	n, err := io.Copy(w, body)
 	if err != nil {
 		if errors.Is(err, context.Canceled) || errors.Is(err, io.ErrClosedPipe) {
 			err = nil
 		}
-		return 0, false, err
+		return n, false, err
+	}
+	if body.N > 0 {
+		// The body ended before the end of the chunk.
+		return n, false, &RangeMismatchError{Requested: chunk, Received: Chunk{chunk.Start, uint64(n)}}
+	}
+	if resp.StatusCode == http.StatusPartialContent {
+		// The body must end with the chunk.
+		if extra, _ := io.CopyN(io.Discard, resp.Body, 1); extra > 0 {
+			return n, false, &RangeMismatchError{Requested: chunk, Received: Chunk{chunk.Start, uint64(n + extra)}}
+		}
 	}
 
 	return n, true, nil
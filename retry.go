@@ -0,0 +1,104 @@
+package chonker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// copyChunkWithRetries copies chunk to w like copyChunk, fetching the rest of
+// the chunk again each time it stalls, up to the retries configured with
+// WithChunkTimeouts, or fails, up to the attempts configured with WithRetry.
+// With ReresolveRedirects, the default, a chunk rejected by the URL redirected
+// to is also requested again, once, from the requested URL, and with a URL refresher,
+// a rejected chunk is requested again, once, from a fresh URL.
+// It returns the number of bytes copied, whether copying succeeded, the number
+// of attempts, the last response, and the error, if any.
+func (r *remoteFileReader) copyChunkWithRetries(
+	ctx context.Context,
+	w io.Writer,
+	chunk Chunk,
+	resp *http.Response,
+	err error,
+) (int64, bool, int, *http.Response, error) {
+	var n int64
+	remaining := chunk
+	reresolved, refreshed := false, false
+	for attempt := 1; ; attempt++ {
+		copied, ok, copyErr := r.copyChunk(w, remaining, resp, err)
+		n += copied
+		if ok || copyErr == nil {
+			return n, ok, attempt, resp, copyErr
+		}
+
+		var retries int
+		var backoff time.Duration
+		reresolve := false
+		switch {
+		case !reresolved && r.shouldReresolve(resp):
+			reresolve, reresolved = true, true
+			retries = attempt
+		case !refreshed && r.shouldRefresh(resp):
+			refreshed = true
+			if refreshErr := r.refreshURL(ctx, sentURL(resp)); refreshErr != nil {
+				return n, false, attempt, resp, fmt.Errorf("%w; error refreshing URL: %w", copyErr, refreshErr)
+			}
+			retries = attempt
+		case errors.Is(copyErr, ErrChunkStalled):
+			getHostMetrics(r.request.URL.Host).requestChunksStalledTotal.Inc()
+			retries = r.request.chunkTimeouts.Retries
+		case isRetryable(resp, copyErr):
+			retries = r.request.retry.Attempts - 1
+			backoff = r.request.retry.Backoff << (attempt - 1)
+		}
+		if attempt > retries || ctx.Err() != nil {
+			return n, false, attempt, resp, copyErr
+		}
+
+		remaining = Chunk{Start: chunk.Start + uint64(n), Length: chunk.Length - uint64(n)}
+		r.request.logger().Warn("chonker: retrying chunk",
+			"url", r.request.URL.String(), "range", remaining.RangeHeader(),
+			"attempt", attempt+1, "backoff", backoff, "error", copyErr)
+		if backoff > 0 {
+			select {
+			case <-ctx.Done():
+				return n, false, attempt, resp, copyErr
+			case <-time.After(backoff):
+			}
+		}
+		if reresolve {
+			// Follow the redirects of the requested URL again.
+			r.target.Store(nil)
+		}
+		resp, err = r.fetchCached(r.chunkRequest(ctx, remaining), remaining) //nolint:bodyclose
+		if reresolve && err == nil {
+			r.resolve(resp)
+		}
+	}
+}
+
+// isRetryable reports whether a chunk that failed with err after getting resp
+// might succeed if fetched again: if there was no response, the server is
+// overloaded or failed, or the body broke off before the end of the chunk.
+func isRetryable(resp *http.Response, err error) bool {
+	if resp == nil {
+		return true
+	}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError:
+		return true
+	case resp.StatusCode == http.StatusPartialContent:
+		// The rest of a short chunk can be fetched again,
+		// but a server that sends the wrong range will most likely do so again.
+		var mismatch *RangeMismatchError
+		if errors.As(err, &mismatch) {
+			return mismatch.short()
+		}
+		return !errors.Is(err, ErrEncodedRange)
+	default:
+		return false
+	}
+}
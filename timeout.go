@@ -0,0 +1,149 @@
+package chonker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrChunkStalled is the error of a chunk that timed out, or was fetched
+// slower than the minimum throughput configured with WithChunkTimeouts.
+var ErrChunkStalled = errors.New("chonker: chunk stalled")
+
+// ChunkTimeouts configures how chunks that stall are detected.
+// A stalled chunk is cancelled on its own, and the rest of it is fetched
+// again, without cancelling the request.
+// Zero values disable the corresponding check.
+type ChunkTimeouts struct {
+	// FirstByte is the time a chunk request has to respond.
+	FirstByte time.Duration
+	// Idle is the time reading a chunk response body may go without
+	// receiving any bytes.
+	Idle time.Duration
+	// MinThroughput is the slowest rate, in bytes per second, that a chunk
+	// response body may be read at. The rate is measured over ThroughputWindow.
+	MinThroughput float64
+	// ThroughputWindow is the time over which the throughput is measured.
+	// It defaults to five seconds.
+	ThroughputWindow time.Duration
+	// Retries is the number of times a stalled chunk is fetched again
+	// before its error is returned.
+	Retries int
+}
+
+const defaultThroughputWindow = 5 * time.Second
+
+// fetch fetches a chunk with req, enforcing the chunk timeouts of the
+// request, if any. If the chunk stalls, its request is cancelled, and reading
+// its body fails with ErrChunkStalled.
+func (r *remoteFileReader) fetch(req *http.Request, chunk Chunk) (*http.Response, error) {
+	t := r.request.chunkTimeouts
+	if t == nil {
+		return r.do(req, chunk)
+	}
+
+	ctx, cancel := context.WithCancelCause(req.Context())
+	req = req.WithContext(ctx)
+	if t.FirstByte > 0 {
+		timer := time.AfterFunc(t.FirstByte, func() {
+			cancel(fmt.Errorf("%w: no response after %s", ErrChunkStalled, t.FirstByte))
+		})
+		defer timer.Stop()
+	}
+
+	resp, err := r.do(req, chunk)
+	if err != nil {
+		if cause := context.Cause(ctx); errors.Is(cause, ErrChunkStalled) {
+			err = cause
+		}
+		cancel(nil)
+		return nil, err
+	}
+	resp.Body = newWatchedBody(resp.Body, t, cancel)
+	return resp, nil
+}
+
+// watchedBody is a response body that cancels its request when reading it
+// stalls. Only the time spent reading counts towards the throughput,
+// so a slow consumer isn't mistaken for a slow server.
+type watchedBody struct {
+	io.ReadCloser
+	timeouts *ChunkTimeouts
+	cancel   context.CancelCauseFunc
+	idle     *time.Timer
+
+	// windowBytes and windowTime are the bytes read and the time spent
+	// reading them in the current throughput window.
+	windowBytes int
+	windowTime  time.Duration
+
+	mu sync.Mutex
+	// err is the reason the body stalled, if it did.
+	err error
+}
+
+func newWatchedBody(body io.ReadCloser, t *ChunkTimeouts, cancel context.CancelCauseFunc) *watchedBody {
+	b := &watchedBody{ReadCloser: body, timeouts: t, cancel: cancel}
+	if t.Idle > 0 {
+		b.idle = time.AfterFunc(t.Idle, func() {
+			b.stall(fmt.Errorf("%w: no bytes received for %s", ErrChunkStalled, t.Idle))
+		})
+		b.idle.Stop()
+	}
+	return b
+}
+
+func (b *watchedBody) stall(err error) {
+	b.mu.Lock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.mu.Unlock()
+	b.cancel(err)
+}
+
+func (b *watchedBody) Read(p []byte) (int, error) {
+	if b.idle != nil {
+		b.idle.Reset(b.timeouts.Idle)
+	}
+	start := time.Now()
+	n, err := b.ReadCloser.Read(p)
+	if b.idle != nil {
+		b.idle.Stop()
+	}
+
+	if minRate := b.timeouts.MinThroughput; minRate > 0 && err == nil {
+		window := b.timeouts.ThroughputWindow
+		if window <= 0 {
+			window = defaultThroughputWindow
+		}
+		b.windowBytes += n
+		b.windowTime += time.Since(start)
+		if b.windowTime >= window {
+			if rate := float64(b.windowBytes) / b.windowTime.Seconds(); rate < minRate {
+				b.stall(fmt.Errorf("%w: read at %.0f bytes/s, below %.0f bytes/s", ErrChunkStalled, rate, minRate))
+			}
+			b.windowBytes, b.windowTime = 0, 0
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return n, b.err
+	}
+	return n, err
+}
+
+func (b *watchedBody) Close() error {
+	if b.idle != nil {
+		b.idle.Stop()
+	}
+	err := b.ReadCloser.Close()
+	b.cancel(nil)
+	return err
+}
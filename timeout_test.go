@@ -0,0 +1,118 @@
+package chonker
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// stallMidway sends half of the chunk and then hangs.
+func stallMidway(w http.ResponseWriter, r *http.Request, c Chunk) {
+	w.Header().Set("Content-Range", c.ContentRangeHeader(1000))
+	w.Header().Set("Content-Length", strconv.FormatUint(c.Length, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(makeData(1000)[c.Start : c.Start+c.Length/2])
+	w.(http.Flusher).Flush()
+	<-r.Context().Done()
+}
+
+// stallBeforeResponding hangs without responding.
+func stallBeforeResponding(_ http.ResponseWriter, r *http.Request, _ Chunk) {
+	<-r.Context().Done()
+}
+
+// trickle sends the chunk one byte at a time.
+func trickle(w http.ResponseWriter, r *http.Request, c Chunk) {
+	w.Header().Set("Content-Range", c.ContentRangeHeader(1000))
+	w.Header().Set("Content-Length", strconv.FormatUint(c.Length, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	for _, b := range makeData(1000)[c.Start : c.Start+c.Length] {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+		w.Write([]byte{b})
+		w.(http.Flusher).Flush()
+	}
+}
+
+func TestDo_ChunkTimeouts(t *testing.T) {
+	tests := []struct {
+		name     string
+		stall    func(http.ResponseWriter, *http.Request, Chunk)
+		timeouts ChunkTimeouts
+		retry    string
+	}{
+		{
+			name:     "idle",
+			stall:    stallMidway,
+			timeouts: ChunkTimeouts{Idle: 50 * time.Millisecond, Retries: 1},
+			retry:    "bytes=505-509",
+		},
+		{
+			name:     "first byte",
+			stall:    stallBeforeResponding,
+			timeouts: ChunkTimeouts{FirstByte: 50 * time.Millisecond, Retries: 1},
+			retry:    "bytes=500-509",
+		},
+		{
+			name:  "throughput",
+			stall: trickle,
+			timeouts: ChunkTimeouts{
+				MinThroughput:    1000,
+				ThroughputWindow: 30 * time.Millisecond,
+				Retries:          1,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := makeData(1000)
+			handler := &contentServer{content: content, hook: answerFirst(1, 500, 510, tt.stall)}
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			req, err := NewRequest(http.MethodGet, server.URL, nil, 10, 4)
+			assert.NoError(t, err)
+			resp, err := Do(nil, req.WithChunkTimeouts(tt.timeouts))
+			assert.NoError(t, err)
+			defer resp.Body.Close()
+
+			got, err := io.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, content, got)
+			if tt.retry != "" {
+				assert.Contains(t, handler.ranges(), tt.retry)
+			}
+		})
+	}
+}
+
+func TestDo_ChunkTimeoutsExhausted(t *testing.T) {
+	content := makeData(1000)
+	server := httptest.NewServer(&contentServer{content: content, hook: answerFirst(3, 500, 510, stallMidway)})
+	defer server.Close()
+
+	req, err := NewRequest(http.MethodGet, server.URL, nil, 10, 4)
+	assert.NoError(t, err)
+	resp, err := Do(nil, req.WithChunkTimeouts(ChunkTimeouts{Idle: 20 * time.Millisecond, Retries: 2}))
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	_, err = io.ReadAll(resp.Body)
+	assert.ErrorIs(t, err, ErrChunkStalled)
+	var chunkErr *ChunkError
+	if assert.True(t, errors.As(err, &chunkErr), fmt.Sprint(err)) {
+		assert.Equal(t, Chunk{500, 10}, chunkErr.Chunk)
+		assert.Equal(t, 3, chunkErr.Attempt)
+	}
+}
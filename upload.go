@@ -0,0 +1,542 @@
+package chonker
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sourcegraph/conc/pool"
+)
+
+const (
+	headerNameContentType  = "Content-Type"
+	headerNameLocation     = "Location"
+	headerNameTusResumable = "Tus-Resumable"
+	headerNameUploadConcat = "Upload-Concat"
+	headerNameUploadLength = "Upload-Length"
+	headerNameUploadOffset = "Upload-Offset"
+
+	tusVersion     = "1.0.0"
+	tusContentType = "application/offset+octet-stream"
+)
+
+// UploadRequest is a ranged upload of content read from an io.ReaderAt.
+// The content is split into chunks, which are uploaded concurrently
+// using an UploadProtocol.
+// Chunks are chunkSize bytes long.
+// A maximum of workers chunks are uploaded concurrently.
+//
+// The embedded http.Request holds the URL and the headers sent with
+// every request of the upload, such as Authorization.
+// Its method and body are ignored.
+type UploadRequest struct {
+	*http.Request
+	src       io.ReaderAt
+	size      uint64
+	protocol  UploadProtocol
+	chunkSize uint64
+	workers   uint
+}
+
+// NewUploadRequestWithContext returns a new UploadRequest given a URL,
+// the content to upload and its size, the upload protocol, chunk size,
+// and number of workers.
+// If chunkSize or workers is zero, ErrInvalidArgument is returned.
+func NewUploadRequestWithContext(
+	ctx context.Context,
+	url string,
+	src io.ReaderAt, size uint64,
+	protocol UploadProtocol,
+	chunkSize uint64, workers uint,
+) (*UploadRequest, error) {
+	if src == nil || protocol == nil {
+		return nil, errors.New("chonker: upload source and protocol cannot be nil")
+	}
+	if chunkSize == 0 || workers == 0 {
+		return nil, ErrInvalidArgument
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &UploadRequest{
+		Request:   req,
+		src:       src,
+		size:      size,
+		protocol:  protocol,
+		chunkSize: chunkSize,
+		workers:   workers,
+	}, nil
+}
+
+// NewUploadRequest returns a new UploadRequest given a URL,
+// the content to upload and its size, the upload protocol, chunk size,
+// and number of workers.
+// If chunkSize or workers is zero, ErrInvalidArgument is returned.
+func NewUploadRequest(
+	url string,
+	src io.ReaderAt, size uint64,
+	protocol UploadProtocol,
+	chunkSize uint64, workers uint,
+) (*UploadRequest, error) {
+	return NewUploadRequestWithContext(context.Background(), url, src, size, protocol, chunkSize, workers)
+}
+
+// newRequest returns a request with method, URL and body that carries the
+// context and headers of r.
+// Bodies are sections of the source, or small buffers, so they can be
+// replayed on redirects.
+func (r *UploadRequest) newRequest(ctx context.Context, method, url string, body io.ReadSeeker, length int64) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = r.Header.Clone()
+	if body != nil {
+		req.Body = io.NopCloser(body)
+		req.ContentLength = length
+		req.GetBody = func() (io.ReadCloser, error) {
+			if _, err := body.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+			return io.NopCloser(body), nil
+		}
+		if length == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	return req, nil
+}
+
+// UploadProtocol is a way of uploading content in chunks.
+// PartialPUT, Tus, and S3Multipart are the available protocols.
+type UploadProtocol interface {
+	// Start begins uploading r and returns the session its chunks
+	// are uploaded with.
+	Start(ctx context.Context, c *http.Client, r *UploadRequest) (UploadSession, error)
+}
+
+// UploadSession is an upload in progress.
+// UploadChunk is called concurrently, once for each chunk.
+// Empty content is uploaded as a single chunk of length zero.
+// Once all chunks are uploaded, Complete is called.
+// If uploading a chunk, or completing the upload, fails, Abort is called.
+type UploadSession interface {
+	// UploadChunk uploads chunk, whose index in the content is part,
+	// starting at zero. The body holds the content of the chunk.
+	UploadChunk(ctx context.Context, c *http.Client, part int, chunk Chunk, body io.ReadSeeker) error
+	// Complete finishes the upload and returns the URL of the uploaded content.
+	Complete(ctx context.Context, c *http.Client) (string, error)
+	// Abort cancels the upload and discards the uploaded chunks, if possible.
+	Abort(ctx context.Context, c *http.Client) error
+}
+
+// chunks returns the chunks the content of r is uploaded in.
+// Empty content is uploaded as a single empty chunk.
+func (r *UploadRequest) chunks() []Chunk {
+	if r.size == 0 {
+		return []Chunk{{}}
+	}
+	return Chunks(r.chunkSize, 0, r.size)
+}
+
+// Upload uploads the content of r in chunks and returns the URL of the
+// uploaded content.
+// If uploading any chunk fails, the remaining uploads are cancelled,
+// the upload is aborted, and the error of the first failed chunk is returned.
+// If completing the upload fails, it is aborted too.
+func Upload(c *http.Client, r *UploadRequest) (string, error) {
+	if r == nil || r.Request == nil {
+		return "", errors.New("chonker: request cannot be nil")
+	}
+	if c == nil {
+		c = http.DefaultClient
+	}
+
+	ctx := r.Context()
+	session, err := r.protocol.Start(ctx, c, r)
+	if err != nil {
+		return "", fmt.Errorf("chonker: starting upload to %s: %w", r.URL, err)
+	}
+
+	uploaders := pool.New().
+		WithContext(ctx).
+		WithCancelOnError().
+		WithFirstError().
+		WithMaxGoroutines(int(r.workers))
+	for part, chunk := range r.chunks() {
+		uploaders.Go(func(ctx context.Context) error {
+			body := io.NewSectionReader(r.src, int64(chunk.Start), int64(chunk.Length))
+			if err := session.UploadChunk(ctx, c, part, chunk, body); err != nil {
+				return fmt.Errorf("chonker: uploading range %s to %s: %w", chunk.RangeHeader(), r.URL, err)
+			}
+			return nil
+		})
+	}
+	if err := uploaders.Wait(); err != nil {
+		if abortErr := session.Abort(context.WithoutCancel(ctx), c); abortErr != nil {
+			err = errors.Join(err, fmt.Errorf("chonker: aborting upload to %s: %w", r.URL, abortErr))
+		}
+		return "", err
+	}
+
+	location, err := session.Complete(ctx, c)
+	if err != nil {
+		err = fmt.Errorf("chonker: completing upload to %s: %w", r.URL, err)
+		if abortErr := session.Abort(context.WithoutCancel(ctx), c); abortErr != nil {
+			err = errors.Join(err, fmt.Errorf("chonker: aborting upload to %s: %w", r.URL, abortErr))
+		}
+		return "", err
+	}
+	return location, nil
+}
+
+// expectStatus sends req and checks that the response status is one of ok.
+// The response body is closed unless the status is ok.
+func expectStatus(c *http.Client, req *http.Request, ok ...int) (*http.Response, error) {
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range ok {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	resp.Body.Close()
+	return nil, fmt.Errorf("%s %s: unexpected status %s", req.Method, req.URL, resp.Status)
+}
+
+// expectStatusDiscard sends req, checks that the response status is one of ok,
+// and discards the response body.
+func expectStatusDiscard(c *http.Client, req *http.Request, ok ...int) (http.Header, error) {
+	resp, err := expectStatus(c, req, ok...)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.Header, nil
+}
+
+// PartialPUT uploads each chunk with a PUT request to the URL of the upload
+// carrying a Content-Range header, as supported by servers that accept
+// partial PUTs, such as WebDAV servers.
+// Every chunk must be answered with a 2xx status.
+// Empty content is uploaded with a single PUT without a Content-Range header.
+type PartialPUT struct{}
+
+// Start implements UploadProtocol.
+func (PartialPUT) Start(_ context.Context, _ *http.Client, r *UploadRequest) (UploadSession, error) {
+	return &partialPUTSession{request: r}, nil
+}
+
+type partialPUTSession struct {
+	request *UploadRequest
+}
+
+func (s *partialPUTSession) UploadChunk(ctx context.Context, c *http.Client, _ int, chunk Chunk, body io.ReadSeeker) error {
+	req, err := s.request.newRequest(ctx, http.MethodPut, s.request.URL.String(), body, int64(chunk.Length))
+	if err != nil {
+		return err
+	}
+	if chunk.Length > 0 {
+		// Empty content has no range, and is uploaded with a plain PUT.
+		req.Header.Set(headerNameContentRange, chunk.ContentRangeHeader(s.request.size))
+	}
+	_, err = expectStatusDiscard(c, req, http.StatusOK, http.StatusCreated, http.StatusNoContent)
+	return err
+}
+
+func (s *partialPUTSession) Complete(context.Context, *http.Client) (string, error) {
+	return s.request.URL.String(), nil
+}
+
+func (s *partialPUTSession) Abort(context.Context, *http.Client) error {
+	return nil
+}
+
+// Tus uploads chunks using the [tus resumable upload protocol].
+// The URL of the upload is the creation URL of a tus server that supports
+// the creation and concatenation extensions.
+// Each chunk is created as a partial upload and uploaded with a PATCH
+// request. The partial uploads are then concatenated into a final upload,
+// whose URL is returned by Upload.
+// Empty content is created as a single final upload of length zero instead.
+// Aborting deletes the partial uploads if the server supports
+// the termination extension.
+//
+// [tus resumable upload protocol]: https://tus.io/protocols/resumable-upload
+type Tus struct{}
+
+// Start implements UploadProtocol.
+func (Tus) Start(_ context.Context, _ *http.Client, r *UploadRequest) (UploadSession, error) {
+	return &tusSession{
+		request:  r,
+		partials: make([]string, len(r.chunks())),
+	}, nil
+}
+
+type tusSession struct {
+	request *UploadRequest
+
+	mu sync.Mutex
+	// partials holds the URLs of the partial uploads, in order.
+	partials []string
+}
+
+func (s *tusSession) UploadChunk(ctx context.Context, c *http.Client, part int, chunk Chunk, body io.ReadSeeker) error {
+	req, err := s.request.newRequest(ctx, http.MethodPost, s.request.URL.String(), nil, 0)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(headerNameTusResumable, tusVersion)
+	req.Header.Set(headerNameUploadLength, strconv.FormatUint(chunk.Length, 10))
+	if s.request.size > 0 {
+		req.Header.Set(headerNameUploadConcat, "partial")
+	}
+	header, err := expectStatusDiscard(c, req, http.StatusCreated)
+	if err != nil {
+		return err
+	}
+	location, err := s.resolve(header.Get(headerNameLocation))
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.partials[part] = location
+	s.mu.Unlock()
+	if s.request.size == 0 {
+		// Empty content is created as the final upload, which is complete
+		// as soon as it is created.
+		return nil
+	}
+
+	req, err = s.request.newRequest(ctx, http.MethodPatch, location, body, int64(chunk.Length))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(headerNameTusResumable, tusVersion)
+	req.Header.Set(headerNameUploadOffset, "0")
+	req.Header.Set(headerNameContentType, tusContentType)
+	header, err = expectStatusDiscard(c, req, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	if offset := header.Get(headerNameUploadOffset); offset != strconv.FormatUint(chunk.Length, 10) {
+		return fmt.Errorf("tus: partial upload %s has offset %q, expected %d", location, offset, chunk.Length)
+	}
+	return nil
+}
+
+func (s *tusSession) Complete(ctx context.Context, c *http.Client) (string, error) {
+	if s.request.size == 0 {
+		return s.partials[0], nil
+	}
+	req, err := s.request.newRequest(ctx, http.MethodPost, s.request.URL.String(), nil, 0)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(headerNameTusResumable, tusVersion)
+	req.Header.Set(headerNameUploadConcat, "final;"+strings.Join(s.partials, " "))
+	header, err := expectStatusDiscard(c, req, http.StatusCreated)
+	if err != nil {
+		return "", err
+	}
+	return s.resolve(header.Get(headerNameLocation))
+}
+
+func (s *tusSession) Abort(ctx context.Context, c *http.Client) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for _, location := range s.partials {
+		if location == "" {
+			continue
+		}
+		req, err := s.request.newRequest(ctx, http.MethodDelete, location, nil, 0)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		req.Header.Set(headerNameTusResumable, tusVersion)
+		if _, err := expectStatusDiscard(c, req, http.StatusNoContent); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// resolve resolves a Location header value against the creation URL.
+func (s *tusSession) resolve(location string) (string, error) {
+	if location == "" {
+		return "", errors.New("tus: missing Location header")
+	}
+	u, err := s.request.URL.Parse(location)
+	if err != nil {
+		return "", fmt.Errorf("tus: invalid Location header %s: %w", location, err)
+	}
+	return u.String(), nil
+}
+
+// S3Multipart uploads chunks using the [S3 multipart upload] flow.
+// The URL of the upload is the URL of the object.
+// The upload is created with a POST request, each chunk is uploaded as a part
+// with a PUT request, and the upload is completed with a POST request listing
+// the ETags of the parts. Aborting deletes the upload and its parts.
+// Requests are not signed; use a client whose transport signs them.
+//
+// S3 requires all parts but the last to be at least 5 MiB long, and allows at
+// most 10,000 parts. Uploads that would break these limits fail with
+// ErrInvalidArgument before anything is uploaded.
+// Empty content is uploaded as a single empty part.
+//
+// [S3 multipart upload]: https://docs.aws.amazon.com/AmazonS3/latest/userguide/mpuoverview.html
+type S3Multipart struct{}
+
+// s3MinPartSize and s3MaxParts are the limits of S3 multipart uploads.
+const (
+	s3MinPartSize = 5 << 20
+	s3MaxParts    = 10000
+)
+
+// Start implements UploadProtocol.
+func (S3Multipart) Start(ctx context.Context, c *http.Client, r *UploadRequest) (UploadSession, error) {
+	parts := (r.size + r.chunkSize - 1) / r.chunkSize
+	if parts > s3MaxParts {
+		return nil, fmt.Errorf("s3: %d parts are more than the %d allowed: %w", parts, s3MaxParts, ErrInvalidArgument)
+	}
+	if parts > 1 && r.chunkSize < s3MinPartSize {
+		return nil, fmt.Errorf("s3: parts of %d bytes are shorter than the 5 MiB allowed: %w", r.chunkSize, ErrInvalidArgument)
+	}
+	req, err := r.newRequest(ctx, http.MethodPost, r.URL.String()+querySeparator(r.URL)+"uploads", nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := expectStatus(c, req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("s3: decoding InitiateMultipartUploadResult: %w", err)
+	}
+	if result.UploadID == "" {
+		return nil, errors.New("s3: missing UploadId")
+	}
+	return &s3MultipartSession{
+		request:  r,
+		uploadID: result.UploadID,
+		etags:    make([]string, len(r.chunks())),
+	}, nil
+}
+
+type s3MultipartSession struct {
+	request  *UploadRequest
+	uploadID string
+
+	mu sync.Mutex
+	// etags holds the ETags of the uploaded parts, in order.
+	etags []string
+}
+
+// url returns the object URL with query parameters added.
+func (s *s3MultipartSession) url(query url.Values) string {
+	query.Set("uploadId", s.uploadID)
+	return s.request.URL.String() + querySeparator(s.request.URL) + query.Encode()
+}
+
+func (s *s3MultipartSession) UploadChunk(ctx context.Context, c *http.Client, part int, chunk Chunk, body io.ReadSeeker) error {
+	query := url.Values{"partNumber": {strconv.Itoa(part + 1)}}
+	req, err := s.request.newRequest(ctx, http.MethodPut, s.url(query), body, int64(chunk.Length))
+	if err != nil {
+		return err
+	}
+	header, err := expectStatusDiscard(c, req, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	etag := header.Get(headerNameETag)
+	if etag == "" {
+		return fmt.Errorf("s3: part %d has no ETag", part+1)
+	}
+	s.mu.Lock()
+	s.etags[part] = etag
+	s.mu.Unlock()
+	return nil
+}
+
+type s3CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+func (s *s3MultipartSession) Complete(ctx context.Context, c *http.Client) (string, error) {
+	complete := struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{}
+	for i, etag := range s.etags {
+		complete.Parts = append(complete.Parts, s3CompletedPart{PartNumber: i + 1, ETag: etag})
+	}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return "", err
+	}
+	req, err := s.request.newRequest(ctx, http.MethodPost, s.url(url.Values{}), bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(headerNameContentType, "application/xml")
+	resp, err := expectStatus(c, req, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	// S3 may report errors with a 200 status once it has started responding.
+	var result struct {
+		XMLName  xml.Name
+		Location string `xml:"Location"`
+		Code     string `xml:"Code"`
+		Message  string `xml:"Message"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("s3: decoding CompleteMultipartUploadResult: %w", err)
+	}
+	if result.XMLName.Local == "Error" {
+		return "", fmt.Errorf("s3: %s: %s", result.Code, result.Message)
+	}
+	if result.Location == "" {
+		return s.request.URL.String(), nil
+	}
+	return result.Location, nil
+}
+
+func (s *s3MultipartSession) Abort(ctx context.Context, c *http.Client) error {
+	req, err := s.request.newRequest(ctx, http.MethodDelete, s.url(url.Values{}), nil, 0)
+	if err != nil {
+		return err
+	}
+	_, err = expectStatusDiscard(c, req, http.StatusNoContent, http.StatusOK)
+	return err
+}
+
+// querySeparator returns the separator to append query parameters to u with.
+func querySeparator(u *url.URL) string {
+	if u.RawQuery == "" {
+		return "?"
+	}
+	return "&"
+}
@@ -0,0 +1,371 @@
+package chonker
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// partialPUTServer stores partial PUTs into a buffer of the final size.
+type partialPUTServer struct {
+	mu      sync.Mutex
+	content []byte
+	// fail is the start of a range that fails to upload, if not negative.
+	fail int
+}
+
+func (s *partialPUTServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get("Content-Range") == "" && r.ContentLength == 0 {
+		// Empty content.
+		s.content = []byte{}
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	chunk, size, err := ParseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if int(chunk.Start) == s.fail {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if s.content == nil {
+		s.content = make([]byte, size)
+	}
+	body, _ := io.ReadAll(r.Body)
+	if uint64(len(body)) != chunk.Length || r.ContentLength != int64(chunk.Length) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	copy(s.content[chunk.Start:], body)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusServer implements the creation, concatenation, and termination
+// extensions of the tus protocol.
+type tusServer struct {
+	mu      sync.Mutex
+	uploads map[string][]byte
+	next    int
+	deleted int
+	// fail is the number of the partial upload whose PATCH fails, if positive.
+	fail int
+}
+
+func (s *tusServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.Header.Get("Tus-Resumable") != "1.0.0" {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	w.Header().Set("Tus-Resumable", "1.0.0")
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/files":
+		concat := r.Header.Get("Upload-Concat")
+		s.next++
+		id := "/files/" + strconv.Itoa(s.next)
+		switch {
+		case concat == "partial":
+			length, _ := strconv.Atoi(r.Header.Get("Upload-Length"))
+			s.uploads[id] = make([]byte, 0, length)
+		case strings.HasPrefix(concat, "final;"):
+			var final []byte
+			for _, partial := range strings.Fields(strings.TrimPrefix(concat, "final;")) {
+				u, ok := s.uploads[strings.TrimPrefix(partial, "http://"+r.Host)]
+				if !ok || len(u) != cap(u) {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				final = append(final, u...)
+			}
+			s.uploads[id] = final
+		case concat == "" && r.Header.Get("Upload-Length") == "0":
+			s.uploads[id] = []byte{}
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Location", id)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPatch:
+		u, ok := s.uploads[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.URL.Path == "/files/"+strconv.Itoa(s.fail) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if r.Header.Get("Content-Type") != "application/offset+octet-stream" ||
+			r.Header.Get("Upload-Offset") != strconv.Itoa(len(u)) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		s.uploads[r.URL.Path] = append(u, body...)
+		w.Header().Set("Upload-Offset", strconv.Itoa(len(u)+len(body)))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		delete(s.uploads, r.URL.Path)
+		s.deleted++
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// s3Server implements the S3 multipart upload API for a single object.
+type s3Server struct {
+	mu      sync.Mutex
+	parts   map[int][]byte
+	object  []byte
+	aborted bool
+	// fail is the number of the part that fails to upload, if positive.
+	fail int
+	// failComplete makes completing the upload fail.
+	failComplete bool
+}
+
+func (s *s3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	query := r.URL.Query()
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.parts = make(map[int][]byte)
+		fmt.Fprint(w, `<InitiateMultipartUploadResult><Bucket>b</Bucket><Key>k</Key><UploadId>u1</UploadId></InitiateMultipartUploadResult>`)
+	case query.Get("uploadId") != "u1":
+		w.WriteHeader(http.StatusNotFound)
+	case r.Method == http.MethodPut:
+		n, _ := strconv.Atoi(query.Get("partNumber"))
+		if n == s.fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		s.parts[n] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"etag-%d"`, n))
+	case r.Method == http.MethodPost:
+		var complete struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&complete); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if s.failComplete {
+			fmt.Fprint(w, `<Error><Code>InternalError</Code><Message>try again</Message></Error>`)
+			return
+		}
+		if len(complete.Parts) == 0 {
+			fmt.Fprint(w, `<Error><Code>MalformedXML</Code><Message>no parts</Message></Error>`)
+			return
+		}
+		for i, p := range complete.Parts {
+			if p.PartNumber != i+1 || p.ETag != fmt.Sprintf(`"etag-%d"`, p.PartNumber) {
+				fmt.Fprint(w, `<Error><Code>InvalidPart</Code><Message>bad part</Message></Error>`)
+				return
+			}
+			s.object = append(s.object, s.parts[p.PartNumber]...)
+		}
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><Location>http://%s/b/k</Location></CompleteMultipartUploadResult>`, r.Host)
+	case r.Method == http.MethodDelete:
+		s.aborted = true
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	content := makeData(1000)
+
+	t.Run("PartialPUT", func(t *testing.T) {
+		handler := &partialPUTServer{fail: -1}
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		req, err := NewUploadRequest(server.URL+"/file", bytes.NewReader(content), uint64(len(content)), PartialPUT{}, 64, 4)
+		assert.NoError(t, err)
+		location, err := Upload(nil, req)
+		assert.NoError(t, err)
+		assert.Equal(t, server.URL+"/file", location)
+		assert.Equal(t, content, handler.content)
+	})
+
+	t.Run("Tus", func(t *testing.T) {
+		handler := &tusServer{uploads: make(map[string][]byte)}
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		req, err := NewUploadRequest(server.URL+"/files", bytes.NewReader(content), uint64(len(content)), Tus{}, 64, 4)
+		assert.NoError(t, err)
+		location, err := Upload(nil, req)
+		assert.NoError(t, err)
+		assert.Equal(t, server.URL+"/files/17", location)
+		assert.Equal(t, content, handler.uploads["/files/17"])
+	})
+
+	t.Run("S3Multipart", func(t *testing.T) {
+		handler := &s3Server{}
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		content := makeData(2*s3MinPartSize + 1000)
+		req, err := NewUploadRequest(server.URL+"/b/k", bytes.NewReader(content), uint64(len(content)), S3Multipart{}, s3MinPartSize, 2)
+		assert.NoError(t, err)
+		location, err := Upload(nil, req)
+		assert.NoError(t, err)
+		assert.Equal(t, server.URL+"/b/k", location)
+		assert.Equal(t, content, handler.object)
+		assert.Len(t, handler.parts, 3)
+	})
+}
+
+func TestUpload_Empty(t *testing.T) {
+	t.Run("PartialPUT", func(t *testing.T) {
+		handler := &partialPUTServer{fail: -1}
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		req, err := NewUploadRequest(server.URL+"/file", bytes.NewReader(nil), 0, PartialPUT{}, 64, 4)
+		assert.NoError(t, err)
+		location, err := Upload(nil, req)
+		assert.NoError(t, err)
+		assert.Equal(t, server.URL+"/file", location)
+		assert.Equal(t, []byte{}, handler.content)
+	})
+
+	t.Run("Tus", func(t *testing.T) {
+		handler := &tusServer{uploads: make(map[string][]byte)}
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		req, err := NewUploadRequest(server.URL+"/files", bytes.NewReader(nil), 0, Tus{}, 64, 4)
+		assert.NoError(t, err)
+		location, err := Upload(nil, req)
+		assert.NoError(t, err)
+		assert.Equal(t, server.URL+"/files/1", location)
+		assert.Equal(t, []byte{}, handler.uploads["/files/1"])
+		assert.Len(t, handler.uploads, 1)
+	})
+
+	t.Run("S3Multipart", func(t *testing.T) {
+		handler := &s3Server{}
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		req, err := NewUploadRequest(server.URL+"/b/k", bytes.NewReader(nil), 0, S3Multipart{}, 300, 2)
+		assert.NoError(t, err)
+		location, err := Upload(nil, req)
+		assert.NoError(t, err)
+		assert.Equal(t, server.URL+"/b/k", location)
+		assert.Empty(t, handler.object)
+		if assert.Len(t, handler.parts, 1) {
+			assert.Empty(t, handler.parts[1])
+		}
+	})
+}
+
+func TestUpload_Errors(t *testing.T) {
+	content := makeData(1000)
+
+	t.Run("PartialPUT", func(t *testing.T) {
+		server := httptest.NewServer(&partialPUTServer{fail: 128})
+		defer server.Close()
+
+		req, err := NewUploadRequest(server.URL, bytes.NewReader(content), uint64(len(content)), PartialPUT{}, 64, 4)
+		assert.NoError(t, err)
+		_, err = Upload(nil, req)
+		assert.ErrorContains(t, err, "uploading range bytes=128-191")
+		assert.ErrorContains(t, err, "500 Internal Server Error")
+	})
+
+	t.Run("Tus", func(t *testing.T) {
+		handler := &tusServer{uploads: make(map[string][]byte), fail: 1}
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		req, err := NewUploadRequest(server.URL+"/files", bytes.NewReader(content), uint64(len(content)), Tus{}, 64, 1)
+		assert.NoError(t, err)
+		_, err = Upload(nil, req)
+		assert.Error(t, err)
+		// The partial upload is deleted.
+		assert.Equal(t, 1, handler.deleted)
+		assert.Empty(t, handler.uploads)
+	})
+
+	t.Run("S3Multipart", func(t *testing.T) {
+		handler := &s3Server{fail: 2}
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		content := makeData(2*s3MinPartSize + 1000)
+		req, err := NewUploadRequest(server.URL+"/b/k", bytes.NewReader(content), uint64(len(content)), S3Multipart{}, s3MinPartSize, 2)
+		assert.NoError(t, err)
+		_, err = Upload(nil, req)
+		assert.ErrorContains(t, err, "uploading range bytes=5242880-10485759")
+		assert.True(t, handler.aborted)
+		assert.Nil(t, handler.object)
+	})
+
+	t.Run("S3Multipart complete", func(t *testing.T) {
+		handler := &s3Server{failComplete: true}
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		req, err := NewUploadRequest(server.URL+"/b/k", bytes.NewReader(content), uint64(len(content)), S3Multipart{}, s3MinPartSize, 2)
+		assert.NoError(t, err)
+		_, err = Upload(nil, req)
+		assert.ErrorContains(t, err, "InternalError")
+		assert.True(t, handler.aborted)
+	})
+
+	t.Run("S3Multipart limits", func(t *testing.T) {
+		handler := &s3Server{}
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		for _, tt := range []struct {
+			size, chunkSize uint64
+		}{
+			// Parts but the last must be at least 5 MiB long.
+			{size: 1000, chunkSize: 300},
+			// There can be at most 10,000 parts.
+			{size: 10001 * s3MinPartSize, chunkSize: s3MinPartSize},
+		} {
+			req, err := NewUploadRequest(server.URL+"/b/k", bytes.NewReader(nil), tt.size, S3Multipart{}, tt.chunkSize, 2)
+			assert.NoError(t, err)
+			_, err = Upload(nil, req)
+			assert.ErrorIs(t, err, ErrInvalidArgument)
+			// Nothing was uploaded.
+			assert.Nil(t, handler.parts)
+		}
+	})
+
+	t.Run("InvalidArgument", func(t *testing.T) {
+		_, err := NewUploadRequest("http://example.com", bytes.NewReader(content), uint64(len(content)), PartialPUT{}, 0, 1)
+		assert.ErrorIs(t, err, ErrInvalidArgument)
+	})
+}